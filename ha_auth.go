@@ -0,0 +1,121 @@
+// Authentication of heartbeats.
+// Every heartbeat carries a sequence number, a timestamp and a HMAC-SHA256 over a canonical encoding of its fields.
+// A heartbeat is dropped when its mac is wrong, its sequence number isn't higher than the last one received from the same peer for the
+// same instance, or its timestamp is more than authWindow away from the local clock (the clocks of the nodes must be synchronized, e.g. with ntp).
+// The sequence number starts from the current time so that it keeps increasing across restarts of the sender. The instances of a daemon
+// share it, the heartbeats of one instance may be sent before those of another one that took a lower number.
+// The mac is keyed with the mac key of a key of the keyring, see ha_keys.go.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const authWindow = time.Second * 30
+
+type authenticator struct {
+	keys *keyring
+
+	m   sync.Mutex
+	seq uint64
+	// lastSeq is keyed by origin
+	lastSeq map[string]uint64
+}
+
+// origin identifies the sender of a heartbeat, e.g. 10.77.0.2/10
+func origin(src string, instance int) string {
+	return src + "/" + strconv.Itoa(instance)
+}
+
+// newAuthenticator returns nil when there are no keys, heartbeats are then neither signed nor verified
+func newAuthenticator(keys *keyring) *authenticator {
+	if keys == nil {
+		return nil
+	}
+	return &authenticator{keys: keys, seq: uint64(time.Now().UnixNano()), lastSeq: make(map[string]uint64)}
+}
+
+// next returns the sequence number and timestamp of the next heartbeat
+func (a *authenticator) next() (uint64, int64) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.seq++
+	return a.seq, time.Now().UnixNano()
+}
+
+// signingKey returns the key heartbeats are signed with
+func (a *authenticator) signingKey() *key {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.keys.current()
+}
+
+// lookup returns the key keyID of a received heartbeat
+func (a *authenticator) lookup(keyID string) (*key, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.keys.lookup(keyID)
+}
+
+// setKeys replaces the keys, e.g. after the key file changed
+func (a *authenticator) setKeys(keys *keyring) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.keys = keys
+}
+
+func (a *authenticator) sign(k *key, data []byte) []byte {
+	h := hmac.New(sha256.New, k.mac)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// verify checks the mac of data with the key keyID and the freshness of a heartbeat of instance received from src
+func (a *authenticator) verify(src string, instance int, keyID string, seq uint64, ts int64, data, mac []byte) error {
+	k, err := a.lookup(keyID)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(a.sign(k, data), mac) {
+		return fmt.Errorf("invalid mac")
+	}
+	return a.fresh(src, instance, seq, ts)
+}
+
+// fresh checks the timestamp and sequence number of an authenticated heartbeat of instance received from src
+func (a *authenticator) fresh(src string, instance int, seq uint64, ts int64) error {
+	if d := time.Since(time.Unix(0, ts)); d > authWindow || d < -authWindow {
+		return fmt.Errorf("timestamp is %s off", d.Round(time.Millisecond))
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	o := origin(src, instance)
+	if seq <= a.lastSeq[o] {
+		return fmt.Errorf("replayed sequence number %d", seq)
+	}
+	a.lastSeq[o] = seq
+	return nil
+}
+
+// canonical encodes the fields of a heartbeat in a fixed order with length prefixes, the mac must not depend on json or fmt formatting
+func canonical(instance, priority int, services []string, state, handover string, seq uint64, ts int64) []byte {
+	var b []byte
+	b = binary.BigEndian.AppendUint64(b, uint64(instance))
+	b = binary.BigEndian.AppendUint64(b, uint64(priority))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(services)))
+	fields := append(append([]string{}, services...), state, handover)
+	for _, s := range fields {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+		b = append(b, s...)
+	}
+	b = binary.BigEndian.AppendUint64(b, seq)
+	b = binary.BigEndian.AppendUint64(b, uint64(ts))
+	return b
+}
@@ -0,0 +1,311 @@
+// Cluster membership shared by systemd_HA.go and systemd_HA_v2.go.
+// Build it together with the daemon, e.g.
+// go build -o systemd-services-HA systemd_HA.go ha_*.go
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peerArray holds the repeated peer flag (-D in v1, -n in v2). A single flag may also carry a comma separated list.
+type peerArray []string
+
+func (p *peerArray) String() string {
+	return strings.Join(*p, ",")
+}
+func (p *peerArray) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v != "" {
+			*p = append(*p, v)
+		}
+	}
+	return nil
+}
+
+// heartbeat is what the cluster keeps from a heartbeat received from a peer
+type heartbeat struct {
+	priority int
+	// node id of the peer, empty for older peers
+	node string
+	// state of the peer and the ip address of the node it hands its services over to, empty for older peers
+	state    string
+	handover string
+	// maintenance is set by a peer that starts and stops nothing, see ha_maintenance.go
+	maintenance bool
+	// fault is set by a peer that is unhealthy or demoted, any healthy node takes the services over from it
+	fault bool
+	// compatible is false when the peer runs a different configuration (services, missing parameters...) which stops the services on every node
+	compatible bool
+}
+
+type peer struct {
+	addr     *net.UDPAddr
+	local    net.IP
+	last     heartbeat
+	lastSeen time.Time
+}
+
+// cluster keeps track of every peer of a service group and elects the highest priority live node as the owner of the services.
+type cluster struct {
+	m        sync.Mutex
+	priority int
+	fault    bool
+	dead     time.Duration
+	started  time.Time
+	peers    []*peer
+	// masterSeen is set once a peer said it runs the services
+	masterSeen bool
+}
+
+func newCluster(addrs []*net.UDPAddr, priority int, dead time.Duration) *cluster {
+	c := &cluster{priority: priority, dead: dead, started: time.Now()}
+	for _, a := range addrs {
+		c.peers = append(c.peers, newPeer(a))
+	}
+	return c
+}
+
+func newPeer(a *net.UDPAddr) *peer {
+	p := &peer{addr: a}
+	// the source address used to reach the peer breaks ties between equal priorities. Dialing udp sends nothing.
+	if l, err := net.DialUDP("udp", nil, a); err == nil {
+		p.local = l.LocalAddr().(*net.UDPAddr).IP
+		l.Close()
+	}
+	return p
+}
+
+// setPeers replaces the peers, the ones already known keep their last heartbeat
+func (c *cluster) setPeers(addrs []*net.UDPAddr) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var peers []*peer
+	for _, a := range addrs {
+		p := newPeer(a)
+		for _, known := range c.peers {
+			if known.addr.String() == a.String() {
+				p = known
+			}
+		}
+		peers = append(peers, p)
+	}
+	c.peers = peers
+}
+
+// addrs returns the address of every peer, heartbeats are sent to all of them
+func (c *cluster) addrs() []*net.UDPAddr {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var addrs []*net.UDPAddr
+	for _, p := range c.peers {
+		addrs = append(addrs, p.addr)
+	}
+	return addrs
+}
+
+// setPriority updates the effective priority of this node. A node in fault (unhealthy or demoted) hands the services over to any healthy live peer.
+func (c *cluster) setPriority(priority int, fault bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if fault != c.fault {
+		if fault {
+			log.Println("giving up mastership to any live peer")
+		} else {
+			log.Println("eligible for mastership again")
+		}
+	}
+	c.priority = priority
+	c.fault = fault
+}
+
+// observe records a heartbeat received from src. Peers are matched on ip address only as the source port of a heartbeat is ephemeral.
+func (c *cluster) observe(src net.IP, hb heartbeat) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	now := time.Now()
+	for _, p := range c.peers {
+		if !p.addr.IP.Equal(src) {
+			continue
+		}
+		switch {
+		case hb.priority == 0 && !p.resigned():
+			log.Println("peer", p.addr, "resigned")
+		case hb.priority > 0 && !c.alive(p, now):
+			log.Println("heartbeat received from peer", p.addr)
+		}
+		p.last = hb
+		p.lastSeen = now
+		if hb.state == stateMaster.String() {
+			c.masterSeen = true
+		}
+		return true
+	}
+	log.Println("heartbeat received from unknown peer", src)
+	return false
+}
+
+// alive reports whether the peer has been heard from within the dead interval and didn't resign. A peer in maintenance may go silent
+// while it is patched or restarted, it is not treated as failed until a heartbeat says it left maintenance.
+func (c *cluster) alive(p *peer, now time.Time) bool {
+	return !p.lastSeen.IsZero() && !p.resigned() && (now.Sub(p.lastSeen) < c.dead || p.last.maintenance)
+}
+
+// resigned reports whether the peer said it shut down with a heartbeat of priority 0, see ha_shutdown.go
+func (p *peer) resigned() bool {
+	return !p.lastSeen.IsZero() && p.last.priority == 0
+}
+
+// settled reports whether every peer has been heard from or has had one dead interval to show up since startup.
+func (c *cluster) settled(now time.Time) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if now.Sub(c.started) >= c.dead {
+		return true
+	}
+	for _, p := range c.peers {
+		if p.lastSeen.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// peerStatus is the view of a peer returned by the control socket
+type peerStatus struct {
+	Address       string     `json:"address"`
+	Node          string     `json:"node,omitempty"`
+	State         string     `json:"state,omitempty"`
+	Priority      int        `json:"priority"`
+	Handover      string     `json:"handover,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	Alive         bool       `json:"alive"`
+	Compatible    bool       `json:"compatible"`
+	Maintenance   bool       `json:"maintenance,omitempty"`
+	Fault         bool       `json:"fault,omitempty"`
+	Resigned      bool       `json:"resigned,omitempty"`
+}
+
+func (c *cluster) snapshot(now time.Time) []peerStatus {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var peers []peerStatus
+	for _, p := range c.peers {
+		s := peerStatus{
+			Address:     p.addr.String(),
+			Node:        p.last.node,
+			State:       p.last.state,
+			Priority:    p.last.priority,
+			Handover:    p.last.handover,
+			Alive:       c.alive(p, now),
+			Compatible:  p.last.compatible,
+			Maintenance: p.last.maintenance,
+			Fault:       p.last.fault,
+			Resigned:    p.resigned(),
+		}
+		if !p.lastSeen.IsZero() {
+			lastSeen := p.lastSeen
+			s.LastHeartbeat = &lastSeen
+		}
+		peers = append(peers, s)
+	}
+	return peers
+}
+
+// setDead changes the dead interval
+func (c *cluster) setDead(dead time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.dead = dead
+}
+
+// hadMaster reports whether a peer ran the services at some point since startup
+func (c *cluster) hadMaster() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.masterSeen
+}
+
+// masterAlive reports whether a live peer runs the services
+func (c *cluster) masterAlive(now time.Time) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, p := range c.peers {
+		if c.alive(p, now) && p.last.state == stateMaster.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceMaster reports whether a peer in maintenance runs the services, nobody takes them over until it leaves maintenance
+func (c *cluster) maintenanceMaster(now time.Time) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, p := range c.peers {
+		if c.alive(p, now) && p.last.maintenance && p.last.state == stateMaster.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// complete reports whether every peer is alive
+func (c *cluster) complete(now time.Time) bool {
+	return len(c.missing(now)) == 0
+}
+
+// missing returns the address of every peer that is not alive, a resigned peer isn't missing as it stopped its services
+func (c *cluster) missing(now time.Time) []*net.UDPAddr {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var addrs []*net.UDPAddr
+	for _, p := range c.peers {
+		if !c.alive(p, now) && !p.resigned() {
+			addrs = append(addrs, p.addr)
+		}
+	}
+	return addrs
+}
+
+// elect returns whether this node is the highest priority live node. On equal priorities the node with the higher ip address wins, like vrrp.
+// A healthy node wins over a node in fault whatever their priorities, among nodes in fault the priorities decide so that the
+// services still run somewhere.
+// conflict is true when a live peer is incompatible, in which case nobody should run the services.
+// Peers in maintenance don't take part, they would neither start nor stop the services.
+func (c *cluster) elect(now time.Time) (master bool, conflict bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	master = true
+	for _, p := range c.peers {
+		if !c.alive(p, now) {
+			// a peer that has never been heard from is given one dead interval to show up
+			if p.lastSeen.IsZero() && now.Sub(c.started) < c.dead {
+				master = false
+			}
+			continue
+		}
+		if !p.last.compatible {
+			conflict = true
+		}
+		if p.last.maintenance || p.last.fault && !c.fault {
+			continue
+		}
+		if c.fault && !p.last.fault {
+			master = false
+			continue
+		}
+		if p.last.priority > c.priority || p.last.priority == c.priority && bytes.Compare(p.addr.IP.To16(), p.local.To16()) > 0 {
+			master = false
+		}
+	}
+	if conflict {
+		master = false
+	}
+	return master, conflict
+}
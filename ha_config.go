@@ -0,0 +1,307 @@
+// Configuration file, given with -CONFIG (systemd_HA.go) or -config (systemd_HA_v2.go) instead of the other flags, e.g.
+//   listen: 0.0.0.0:9000
+//   interface: eth0                # systemd_HA.go only
+//   instance: 10
+//   priority: 100
+//   peers: [10.77.0.2:9000, 10.77.0.3:9000]
+//   services: [data.mount/30s, postgresql/5m, app+worker]   # start order, see ha_steps.go
+//   vips: [10.77.0.10/24]          # systemd_HA.go only
+//   probes: ["service=nginx,type=http,target=http://127.0.0.1/,weight=50"]
+//   track: ["type=interface,target=eth1,weight=50", "type=script,target=/etc/scripts/check-gw.sh"]   # see ha_track.go
+//   arbiter: 10.77.0.1:9100
+//   reach: [10.77.0.1]
+//   fences: ["type=ssh,user=root"]
+//   key_file: /etc/systemd-services-HA/keys
+//   control: /run/systemd-services-HA.sock
+//   metrics: 127.0.0.1:9310
+//   state_file: /var/lib/systemd-services-HA/state.json   # see ha_persist.go, empty to start over on every restart
+//   advert_interval: 2s            # time between two heartbeats
+//   dead_adverts: 5                # a peer is dead after this many missed heartbeats
+//   failback_delay: 0s             # how long a recovered node waits before taking the services over from a live master
+//   nopreempt: false               # a live master keeps the services even when a node with a higher priority comes back
+//   flap_threshold: 6              # role changes within flap_window that hold the node, 0 (the default) to disable, see ha_flap.go
+//   flap_window: 10m
+//   flap_cooldown: 30m             # 0 to wait for hactl reset
+//   notify: ["type=exec,target=/etc/scripts/notify.sh", "type=http,target=https://hooks.example.com/ha", "type=syslog"]
+//   shutdown: stop                 # stop the services and resign on SIGTERM, or keep them running, see ha_shutdown.go
+//   maintenance_file: /var/lib/systemd-services-HA/maintenance-{instance}   # see ha_maintenance.go, empty to not keep maintenance across restarts
+// Probes, tracked items, fences and notifications use the same syntax as the flags, priority defaults to 100 and instance to 10.
+//
+// One daemon can run several instances, see ha_daemon.go. listen, interface, key, key_file, control, metrics and state_file are shared,
+// every other setting can be given per instance and is taken from the top level when it is left out, e.g.
+//   listen: 0.0.0.0:9000
+//   interface: eth0
+//   peers: [10.77.0.2:9000]
+//   instances:
+//     - {instance: 10, priority: 150, services: [postgresql], vips: [10.77.0.10/24]}
+//     - {instance: 20, priority: 50, services: [redis], vips: [10.77.0.20/24]}
+//
+// On SIGHUP the file is read again: priority, peers, probes, tracked items, arbiter, reach, fences, key and key_file (and the content of the key file),
+// the order and timeouts of the services, the timers, nopreempt, flap damping, notifications, the maintenance file and shutdown are applied without any transition.
+// Changing any other setting, or adding or removing an instance, needs a restart, the whole file is then rejected with an error
+// in the log and the running configuration is kept.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type config struct {
+	Listen    string `yaml:"listen"`
+	Interface string `yaml:"interface"`
+	Key       string `yaml:"key"`
+	KeyFile   string `yaml:"key_file"`
+	Control   string `yaml:"control"`
+	Metrics   string `yaml:"metrics"`
+	StateFile string `yaml:"state_file"`
+
+	instanceConfig `yaml:",inline"`
+	RawInstances   []map[string]interface{} `yaml:"instances"`
+	// Instances are the instances to run, the top level one when the file has no instances
+	Instances []instanceConfig `yaml:"-"`
+}
+
+// instanceConfig holds the settings of one instance
+type instanceConfig struct {
+	Instance int      `yaml:"instance"`
+	Priority int      `yaml:"priority"`
+	Peers    []string `yaml:"peers"`
+	Services []string `yaml:"services"`
+	VIPs     []string `yaml:"vips"`
+	Probes   []string `yaml:"probes"`
+	Track    []string `yaml:"track"`
+	Arbiter  string   `yaml:"arbiter"`
+	Reach    []string `yaml:"reach"`
+	Fences   []string `yaml:"fences"`
+
+	AdvertInterval time.Duration `yaml:"advert_interval"`
+	DeadAdverts    int           `yaml:"dead_adverts"`
+	FailbackDelay  time.Duration `yaml:"failback_delay"`
+	NoPreempt      bool          `yaml:"nopreempt"`
+	FlapThreshold  int           `yaml:"flap_threshold"`
+	FlapWindow     time.Duration `yaml:"flap_window"`
+	FlapCooldown   time.Duration `yaml:"flap_cooldown"`
+	Notify         []string      `yaml:"notify"`
+
+	MaintenanceFile string `yaml:"maintenance_file"`
+	Shutdown        string `yaml:"shutdown"`
+}
+
+// loadConfig reads the configuration file, unknown keys are an error
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &config{Control: "/run/systemd-services-HA.sock", StateFile: defaultStateFile, instanceConfig: instanceConfig{Priority: 100, Instance: 10,
+		AdvertInterval: time.Second * 2, DeadAdverts: 5, FlapThreshold: 0, FlapWindow: time.Minute * 10, FlapCooldown: time.Minute * 30,
+		MaintenanceFile: defaultMaintenanceFile, Shutdown: "stop"}}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if c.Listen == "" {
+		return nil, fmt.Errorf("%s: listen must not be empty", path)
+	}
+	for _, raw := range c.RawInstances {
+		// the settings of the top level are the defaults of every instance
+		ic := c.instanceConfig
+		b, err := yaml.Marshal(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := yaml.UnmarshalStrict(b, &ic); err != nil {
+			return nil, fmt.Errorf("%s: instance %v: %v", path, raw["instance"], err)
+		}
+		c.Instances = append(c.Instances, ic)
+	}
+	if len(c.Instances) == 0 {
+		c.Instances = []instanceConfig{c.instanceConfig}
+	}
+	seen := make(map[int]bool)
+	for _, ic := range c.Instances {
+		if seen[ic.Instance] {
+			return nil, fmt.Errorf("%s: instance %d is given twice", path, ic.Instance)
+		}
+		seen[ic.Instance] = true
+		if err := ic.check(); err != nil {
+			return nil, fmt.Errorf("%s: instance %d: %v", path, ic.Instance, err)
+		}
+	}
+	return c, nil
+}
+
+// check validates the settings of an instance that are not checked when its parts are built
+func (ic *instanceConfig) check() error {
+	if len(ic.Peers) == 0 || len(ic.Services) == 0 {
+		return fmt.Errorf("peers and services must not be empty")
+	}
+	// 0 is advertised by a node that shut down and maxPriority by a promoted, frozen or held master
+	if ic.Priority < 1 || ic.Priority >= maxPriority {
+		return fmt.Errorf("Incorrect priority %d, use 1 to %d", ic.Priority, maxPriority-1)
+	}
+	if _, _, err := parseSteps(ic.Services); err != nil {
+		return err
+	}
+	if err := checkShutdown(ic.Shutdown); err != nil {
+		return err
+	}
+	return checkTimers(ic.AdvertInterval, ic.DeadAdverts, ic.FailbackDelay)
+}
+
+// restartRequired returns the settings that differ from old and can't be applied while running
+func (c *config) restartRequired(old *config) []string {
+	var changed []string
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	check("listen", c.Listen, old.Listen)
+	check("interface", c.Interface, old.Interface)
+	check("control", c.Control, old.Control)
+	check("metrics", c.Metrics, old.Metrics)
+	check("state_file", c.StateFile, old.StateFile)
+	instances := func(c *config) map[int]instanceConfig {
+		m := make(map[int]instanceConfig)
+		for _, ic := range c.Instances {
+			m[ic.Instance] = ic
+		}
+		return m
+	}
+	current, previous := instances(c), instances(old)
+	for id := range previous {
+		if _, ok := current[id]; !ok {
+			changed = append(changed, fmt.Sprintf("instance %d removed", id))
+		}
+	}
+	for _, ic := range c.Instances {
+		prev, ok := previous[ic.Instance]
+		if !ok {
+			changed = append(changed, fmt.Sprintf("instance %d added", ic.Instance))
+			continue
+		}
+		// the order and timeouts of the services can change, not the units
+		_, units, _ := parseSteps(ic.Services)
+		_, oldUnits, _ := parseSteps(prev.Services)
+		check(fmt.Sprintf("instance %d services", ic.Instance), serviceSetHash(units), serviceSetHash(oldUnits))
+		check(fmt.Sprintf("instance %d vips", ic.Instance), ic.VIPs, prev.VIPs)
+	}
+	return changed
+}
+
+// watchConfig reloads the configuration file on SIGHUP. It never returns.
+func (d *daemon) watchConfig(path string, c *config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		next, err := d.reload(path, c)
+		if err != nil {
+			log.Println("configuration not reloaded:", err)
+			continue
+		}
+		c = next
+		log.Println("configuration reloaded from", path)
+	}
+}
+
+// reload reads the configuration file again and applies it when only settings that are safe to change live changed.
+// Nothing is applied, to any instance, when it returns an error.
+func (d *daemon) reload(path string, old *config) (*config, error) {
+	c, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if changed := c.restartRequired(old); len(changed) > 0 {
+		return nil, fmt.Errorf("%v changed, restart the daemon to apply them", changed)
+	}
+	keys, err := newKeyring(c.Key, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if (keys == nil) != (d.auth == nil) {
+		// peers would drop every heartbeat until they are reconfigured as well
+		return nil, fmt.Errorf("enabling or disabling the key needs a restart")
+	}
+	var updates []func()
+	for _, ic := range c.Instances {
+		update, err := ic.prepare(d.nodes[ic.Instance])
+		if err != nil {
+			return nil, fmt.Errorf("instance %d: %v", ic.Instance, err)
+		}
+		updates = append(updates, update)
+	}
+	for _, update := range updates {
+		update()
+	}
+	if d.auth != nil {
+		d.auth.setKeys(keys)
+	}
+	return c, nil
+}
+
+// prepare builds the settings of the instance that can change live and returns the function that applies them to n
+func (ic instanceConfig) prepare(n *node) (func(), error) {
+	steps, units, _ := parseSteps(ic.Services)
+	var peers []*net.UDPAddr
+	for _, p := range ic.Peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return nil, fmt.Errorf("Incorrect peer address %s", p)
+		}
+		peers = append(peers, addr)
+	}
+	h, err := newHealth(ic.Probes, units)
+	if err != nil {
+		return nil, err
+	}
+	tracking, err := newTracker(ic.Track)
+	if err != nil {
+		return nil, err
+	}
+	quorum, err := newWitness(ic.Arbiter, ic.Reach, ic.Instance)
+	if err != nil {
+		return nil, err
+	}
+	fencing, err := newFencer(ic.Fences, units)
+	if err != nil {
+		return nil, err
+	}
+	flaps, err := newDamper(ic.FlapThreshold, ic.FlapWindow, ic.FlapCooldown)
+	if err != nil {
+		return nil, err
+	}
+	notify, err := newNotifier(ic.Notify, units, ic.Instance)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		n.m.Lock()
+		if ic.Priority != n.priority {
+			log.Printf("instance %d: priority changed from %d to %d", n.instance, n.priority, ic.Priority)
+		}
+		n.priority = ic.Priority
+		n.quorum = quorum
+		n.fencing = fencing
+		n.nopreempt = ic.NoPreempt
+		n.steps = steps
+		n.maintenanceFile = maintenancePath(ic.MaintenanceFile, ic.Instance)
+		n.onShutdown = ic.Shutdown
+		n.m.Unlock()
+		n.setTimers(ic.AdvertInterval, ic.DeadAdverts, ic.FailbackDelay)
+		n.flaps.set(flaps)
+		n.notify.set(notify)
+		n.health.setProbes(h)
+		n.tracking.set(tracking)
+		n.members.setPeers(peers)
+	}, nil
+}
@@ -0,0 +1,186 @@
+// Local status and control API, served as http over a unix socket.
+// Every request takes the instance it applies to as ?instance=<id>, it can be left out when the daemon runs a single instance.
+// GET  /instances                 status of every instance as a json list
+// GET  /status                    current state, priorities, peers and services as json
+// POST /demote                    hand the services over to a live peer
+// POST /promote                   advertise the highest priority to take the services over
+// POST /auto                      clear demote/promote and follow the election again
+// POST /maintenance?on=true|false suspend or resume the transitions, kept across restarts, see ha_maintenance.go
+// POST /freeze?on=true|false      keep the current master in place
+// POST /switchover?to=<ip>        hand the services over to a live peer, see hactl.go
+// POST /reset                     end the hold of a flapping node, see ha_flap.go, and forget the failed probes and units
+// e.g. curl --unix-socket /run/systemd-services-HA.sock http://localhost/status
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+type serviceStatus struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	Error  string `json:"error,omitempty"`
+}
+
+type nodeStatus struct {
+	Instance          int             `json:"instance"`
+	State             string          `json:"state"`
+	Since             time.Time       `json:"since"`
+	Priority          int             `json:"priority"`
+	EffectivePriority int             `json:"effective_priority"`
+	Override          string          `json:"override,omitempty"`
+	Maintenance       bool            `json:"maintenance"`
+	Frozen            bool            `json:"frozen"`
+	Handover          string          `json:"handover,omitempty"`
+	HeldSince         *time.Time      `json:"held_since,omitempty"`
+	Peers             []peerStatus    `json:"peers"`
+	Services          []serviceStatus `json:"services"`
+	Tracks            []trackStatus   `json:"tracks,omitempty"`
+}
+
+func (n *node) status() nodeStatus {
+	state, since := n.fsm.status()
+	effective, _ := n.effective()
+	n.m.Lock()
+	s := nodeStatus{
+		Instance:          n.instance,
+		State:             state.String(),
+		Since:             since,
+		Priority:          n.priority,
+		EffectivePriority: effective,
+		Override:          n.override,
+		Maintenance:       n.maintenance,
+		Frozen:            n.frozen,
+	}
+	if n.handover != nil {
+		s.Handover = n.handover.String()
+	}
+	n.m.Unlock()
+	if since := n.flaps.since(); !since.IsZero() {
+		s.HeldSince = &since
+	}
+	s.Peers = n.members.snapshot(time.Now())
+	s.Tracks = n.tracking.status()
+	for _, name := range n.services {
+		active, err := n.units.isActive(name)
+		service := serviceStatus{Name: name, Active: active}
+		if err != nil {
+			service.Error = err.Error()
+		}
+		s.Services = append(s.Services, service)
+	}
+	return s
+}
+
+// serveControl listens on the unix socket path. It returns once the socket is bound.
+func (d *daemon) serveControl(path string) error {
+	// a socket left behind by a previous run would make listen fail
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/instances", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var s []nodeStatus
+		for _, n := range d.list() {
+			s = append(s, n.status())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := d.lookup(r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeStatus(w, n.status())
+	})
+	mux.HandleFunc("/demote", d.command(func(n *node, r *http.Request) error {
+		n.setOverride("demote")
+		return nil
+	}))
+	mux.HandleFunc("/promote", d.command(func(n *node, r *http.Request) error {
+		n.setOverride("promote")
+		return nil
+	}))
+	mux.HandleFunc("/auto", d.command(func(n *node, r *http.Request) error {
+		n.setOverride("")
+		return nil
+	}))
+	mux.HandleFunc("/maintenance", d.command(func(n *node, r *http.Request) error {
+		on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+		if err != nil {
+			return err
+		}
+		return n.setMaintenance(on)
+	}))
+	mux.HandleFunc("/freeze", d.command(func(n *node, r *http.Request) error {
+		on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+		if err != nil {
+			return err
+		}
+		n.setFrozen(on)
+		return nil
+	}))
+	mux.HandleFunc("/reset", d.command(func(n *node, r *http.Request) error {
+		n.flaps.release()
+		n.health.reset()
+		return nil
+	}))
+	mux.HandleFunc("/switchover", d.command(func(n *node, r *http.Request) error {
+		return n.switchover(r.URL.Query().Get("to"))
+	}))
+	log.Println("control socket listening at", path)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Println("control socket:", err)
+		}
+	}()
+	return nil
+}
+
+// command runs f on POST against the node of the requested instance and replies with its status
+func (d *daemon) command(f func(n *node, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := d.lookup(r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := f(n, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeStatus(w, n.status())
+	}
+}
+
+func writeStatus(w http.ResponseWriter, s nodeStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,195 @@
+// A daemon runs one or more instances, each an independent service group with its own instance id, peers, priority, services and
+// virtual ip addresses, e.g. to spread a dozen service pairs over two hosts with different masters. The instances share the listen
+// socket, the keys, the control socket and the metrics. Received heartbeats are handed to the node of their instance id,
+// heartbeats of other instances are ignored.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+type daemon struct {
+	nodes map[int]*node
+	// ids are the instance ids in ascending order
+	ids  []int
+	auth *authenticator
+	// stats counts the heartbeats dropped before their instance is known
+	stats counters
+	// stateFile keeps the state across restarts, see ha_persist.go
+	stateFile string
+}
+
+// newDaemon builds a node for every instance of c. ief is the interface holding the virtual ip addresses, nil when there are none.
+func newDaemon(c *config, ief *net.Interface) (*daemon, error) {
+	keys, err := newKeyring(c.Key, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	d := &daemon{nodes: make(map[int]*node), auth: newAuthenticator(keys), stateFile: c.StateFile}
+	for _, ic := range c.Instances {
+		n, err := newNode(ic, ief, d.auth)
+		if err != nil {
+			if len(c.Instances) > 1 {
+				return nil, fmt.Errorf("instance %d: %v", ic.Instance, err)
+			}
+			return nil, err
+		}
+		if len(c.Instances) > 1 {
+			n.fsm.name = fmt.Sprintf("instance %d", ic.Instance)
+		}
+		d.nodes[ic.Instance] = n
+		d.ids = append(d.ids, ic.Instance)
+	}
+	sort.Ints(d.ids)
+	if d.stateFile != "" {
+		if err := d.restore(d.stateFile); err != nil {
+			log.Println("state of the previous run ignored:", err)
+		}
+	}
+	return d, nil
+}
+
+// newNode builds the node of an instance, the heartbeats of every instance are signed with the same authenticator
+func newNode(ic instanceConfig, ief *net.Interface, auth *authenticator) (*node, error) {
+	if err := ic.check(); err != nil {
+		return nil, err
+	}
+	steps, services, _ := parseSteps(ic.Services)
+	var peers []*net.UDPAddr
+	for _, p := range ic.Peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return nil, fmt.Errorf("Incorrect peer address %s", p)
+		}
+		peers = append(peers, addr)
+	}
+	addrs, err := newVIP(ief, ic.VIPs)
+	if err != nil {
+		return nil, err
+	}
+	h, err := newHealth(ic.Probes, services)
+	if err != nil {
+		return nil, err
+	}
+	tracking, err := newTracker(ic.Track)
+	if err != nil {
+		return nil, err
+	}
+	quorum, err := newWitness(ic.Arbiter, ic.Reach, ic.Instance)
+	if err != nil {
+		return nil, err
+	}
+	fencing, err := newFencer(ic.Fences, services)
+	if err != nil {
+		return nil, err
+	}
+	flaps, err := newDamper(ic.FlapThreshold, ic.FlapWindow, ic.FlapCooldown)
+	if err != nil {
+		return nil, err
+	}
+	notify, err := newNotifier(ic.Notify, services, ic.Instance)
+	if err != nil {
+		return nil, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	n := &node{
+		instance:  ic.Instance,
+		host:      host,
+		services:  services,
+		priority:  ic.Priority,
+		members:   newCluster(peers, ic.Priority, ic.AdvertInterval*time.Duration(ic.DeadAdverts)),
+		health:    h,
+		tracking:  tracking,
+		quorum:    quorum,
+		fencing:   fencing,
+		units:     newUnitManager(),
+		addrs:     addrs,
+		fsm:       newStateMachine(),
+		auth:      auth,
+		flaps:     flaps,
+		steps:     steps,
+		notify:    notify,
+		advert:    ic.AdvertInterval,
+		failback:  ic.FailbackDelay,
+		nopreempt: ic.NoPreempt,
+
+		onShutdown: ic.Shutdown,
+
+		maintenanceFile: maintenancePath(ic.MaintenanceFile, ic.Instance),
+	}
+	// maintenance turned on before a restart stays on
+	n.syncMaintenance()
+	return n, nil
+}
+
+// start starts every node and saves their state from then on
+func (d *daemon) start() {
+	for _, id := range d.ids {
+		d.nodes[id].start()
+	}
+	if d.stateFile != "" {
+		d.persist(d.stateFile)
+	}
+}
+
+// list returns the nodes in the order of their instance ids
+func (d *daemon) list() []*node {
+	nodes := make([]*node, 0, len(d.ids))
+	for _, id := range d.ids {
+		nodes = append(nodes, d.nodes[id])
+	}
+	return nodes
+}
+
+// lookup returns the node of the instance id given as a string, it may be empty when the daemon runs a single instance
+func (d *daemon) lookup(instance string) (*node, error) {
+	if instance == "" {
+		if len(d.ids) == 1 {
+			return d.nodes[d.ids[0]], nil
+		}
+		return nil, fmt.Errorf("this daemon runs the instances %v, choose one", d.ids)
+	}
+	var id int
+	if _, err := fmt.Sscan(instance, &id); err != nil {
+		return nil, fmt.Errorf("incorrect instance %s", instance)
+	}
+	n, ok := d.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("this daemon doesn't run instance %d", id)
+	}
+	return n, nil
+}
+
+// nextPacket returns the next heartbeat of the node, see ha_wire.go
+func (n *node) nextPacket() packet {
+	priority, fault := n.effective()
+	// a resigning node advertises priority 0
+	p := packet{
+		instance:    n.instance,
+		node:        n.host,
+		role:        n.fsm.current(),
+		priority:    priority,
+		services:    serviceSetHash(n.services),
+		handover:    n.handoverTarget(),
+		maintenance: n.inMaintenance(),
+		fault:       fault,
+	}
+	n.m.Lock()
+	if n.resigned {
+		p.priority = 0
+	}
+	n.m.Unlock()
+	if n.auth != nil {
+		p.seq, p.time = n.auth.next()
+	}
+	return p
+}
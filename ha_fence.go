@@ -0,0 +1,144 @@
+// Fencing of silent peers before this node takes over their services.
+// A fencing action is given as a comma separated list of key=value, e.g.
+// type=exec,target=/etc/scripts/fence.sh          runs the script with HA_PEER and HA_SERVICES in its environment
+// type=http,target=http://pdu/outlet/off?host={peer},method=POST,status=200
+// type=ssh,user=root                              runs systemctl stop on the peer with the services
+// Every action must succeed for every silent peer, otherwise the node stays passive.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fenceArray holds the repeated fencing flag
+type fenceArray []string
+
+func (f *fenceArray) String() string {
+	return strings.Join(*f, " ")
+}
+func (f *fenceArray) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+const fenceTimeout = time.Second * 30
+
+type fence struct {
+	kind   string
+	target string
+	user   string
+	method string
+	status int
+}
+
+type fencer struct {
+	fences   []*fence
+	services []string
+}
+
+func parseFence(spec string) (*fence, error) {
+	f := &fence{method: http.MethodPost, user: "root"}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("Incorrect fencing action %s", spec)
+		}
+		var err error
+		switch k {
+		case "type":
+			f.kind = v
+		case "target":
+			f.target = v
+		case "user":
+			f.user = v
+		case "method":
+			f.method = v
+		case "status":
+			f.status, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("unknown key %s", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Incorrect fencing action %s: %v", spec, err)
+		}
+	}
+	switch f.kind {
+	case "exec", "http":
+		if f.target == "" {
+			return nil, fmt.Errorf("Incorrect fencing action %s: target is missing", spec)
+		}
+	case "ssh":
+	default:
+		return nil, fmt.Errorf("Incorrect fencing action %s: unknown type %s", spec, f.kind)
+	}
+	return f, nil
+}
+
+func newFencer(specs []string, services []string) (*fencer, error) {
+	f := &fencer{services: services}
+	for _, s := range specs {
+		action, err := parseFence(s)
+		if err != nil {
+			return nil, err
+		}
+		f.fences = append(f.fences, action)
+	}
+	return f, nil
+}
+
+// fence runs every fencing action against every peer, one after the other. It returns the first failure.
+// expect is called before each action with the time it may take, see ha_sdnotify.go.
+func (f *fencer) fence(peers []*net.UDPAddr, expect func(time.Duration)) error {
+	for _, p := range peers {
+		for _, action := range f.fences {
+			expect(fenceTimeout)
+			if err := action.run(p.IP.String(), f.services); err != nil {
+				return fmt.Errorf("%s fencing of %s failed: %v", action.kind, p.IP, err)
+			}
+			log.Printf("%s fencing of %s succeeded", action.kind, p.IP)
+		}
+	}
+	return nil
+}
+
+func (f *fence) run(peer string, services []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), fenceTimeout)
+	defer cancel()
+	switch f.kind {
+	case "exec":
+		cmd := exec.CommandContext(ctx, f.target)
+		cmd.Env = append(os.Environ(), "HA_PEER="+peer, "HA_SERVICES="+strings.Join(services, " "))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+	case "ssh":
+		args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=5", f.user + "@" + peer, "systemctl", "stop"}
+		if out, err := exec.CommandContext(ctx, "ssh", append(args, services...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, f.method, strings.ReplaceAll(f.target, "{peer}", peer), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if f.status != 0 && resp.StatusCode != f.status || f.status == 0 && resp.StatusCode/100 != 2 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Flap damping. Every time this node starts or stops the services (enters or leaves MASTER) is counted over a sliding window.
+// Once threshold changes happened within the window the node is held: it keeps its current role and a held master keeps the services
+// like a frozen one, until the cool-down passed or the operator resets it (hactl reset). A held node still fails over: a held backup
+// takes the services over when no live master runs them and a held master gives them up when it is in fault, see node.failover.
+// A threshold of 0, the default, disables the damping, a cool-down of 0 needs the operator.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type damper struct {
+	m         sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	changes   []time.Time
+	heldSince time.Time
+}
+
+func newDamper(threshold int, window, cooldown time.Duration) (*damper, error) {
+	if threshold < 0 || threshold == 1 {
+		return nil, fmt.Errorf("Incorrect flap threshold %d, use 0 to disable or at least 2", threshold)
+	}
+	if window <= 0 || cooldown < 0 {
+		return nil, fmt.Errorf("Incorrect flap window %s or cool-down %s", window, cooldown)
+	}
+	return &damper{threshold: threshold, window: window, cooldown: cooldown}, nil
+}
+
+// set takes the settings of other, e.g. after the configuration changed
+func (d *damper) set(other *damper) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.threshold, d.window, d.cooldown = other.threshold, other.window, other.cooldown
+}
+
+// record counts a transition of the state machine
+func (d *damper) record(t transition) {
+	if t.From != stateMaster && t.To != stateMaster {
+		return
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	changes := d.changes[:0]
+	for _, c := range d.changes {
+		if t.At.Sub(c) < d.window {
+			changes = append(changes, c)
+		}
+	}
+	d.changes = append(changes, t.At)
+	if d.threshold > 0 && len(d.changes) >= d.threshold && d.heldSince.IsZero() {
+		log.Printf("ALERT: %d role changes within %s, holding the %s role", len(d.changes), d.window, t.To)
+		d.heldSince = t.At
+	}
+}
+
+// held reports whether the node is held, the hold ends once the cool-down passed
+func (d *damper) held(now time.Time) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.heldSince.IsZero() {
+		return false
+	}
+	if d.cooldown > 0 && now.Sub(d.heldSince) >= d.cooldown {
+		log.Println("flap hold cooled down after", d.cooldown)
+		d.reset()
+		return false
+	}
+	return true
+}
+
+// hold holds the node since the given time, e.g. when it was held before a restart
+func (d *damper) hold(since time.Time) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	log.Println("holding the role as before the restart, since", since.Format(time.RFC3339))
+	d.heldSince = since
+}
+
+// since returns when the node was held, zero when it isn't
+func (d *damper) since() time.Time {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.heldSince
+}
+
+// release ends the hold and forgets the past role changes
+func (d *damper) release() {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if !d.heldSince.IsZero() {
+		log.Println("flap hold reset by the operator")
+	}
+	d.reset()
+}
+
+func (d *damper) reset() {
+	d.heldSince = time.Time{}
+	d.changes = nil
+}
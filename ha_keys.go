@@ -0,0 +1,119 @@
+// Keys used to encrypt and authenticate the heartbeats.
+// A key is derived from a passphrase with scrypt (golang.org/x/crypto/scrypt), the encryption and mac keys are then derived from it with HKDF.
+// Keys are given either as a single passphrase or as a key file with one key per line:
+//   # id passphrase [not-after]
+//   2026-10 correct-horse-battery-staple
+//   2026-09 previous-passphrase 2026-11-01T00:00:00Z
+// The first key is used to send and never expires, every other key is accepted until its not-after time. Each heartbeat carries the id
+// of its key, so a new key can be rolled out to every node as the second line, then moved to the first line once all nodes have it.
+// An expiring first key would make every node drop the heartbeats of its peers once it expires and take the services over.
+
+package main
+
+import (
+	"bufio"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+type key struct {
+	id       string
+	enc      []byte
+	mac      []byte
+	notAfter time.Time
+}
+
+type keyring struct {
+	keys []*key
+}
+
+func deriveKey(id, passphrase string, notAfter time.Time) (*key, error) {
+	master, err := scrypt.Key([]byte(passphrase), []byte("systemd-services-HA:"+id), 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	k := &key{id: id, notAfter: notAfter}
+	if k.enc, err = hkdf.Key(sha256.New, master, nil, "systemd-services-HA encryption", 32); err != nil {
+		return nil, err
+	}
+	if k.mac, err = hkdf.Key(sha256.New, master, nil, "systemd-services-HA authentication", 32); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// newKeyring loads the key file, or derives a single key from the passphrase. It returns nil when neither is given.
+func newKeyring(passphrase, file string) (*keyring, error) {
+	if file == "" {
+		if passphrase == "" {
+			return nil, nil
+		}
+		k, err := deriveKey("default", passphrase, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		return &keyring{keys: []*key{k}}, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &keyring{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected id, passphrase and an optional not-after time", file, line)
+		}
+		var notAfter time.Time
+		if len(fields) == 3 {
+			if len(r.keys) == 0 {
+				return nil, fmt.Errorf("%s:%d: the first key is used to send, it can't have a not-after time", file, line)
+			}
+			if notAfter, err = time.Parse(time.RFC3339, fields[2]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+		}
+		k, err := deriveKey(fields[0], fields[1], notAfter)
+		if err != nil {
+			return nil, err
+		}
+		r.keys = append(r.keys, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(r.keys) == 0 {
+		return nil, fmt.Errorf("%s: no key found", file)
+	}
+	return r, nil
+}
+
+// current returns the key used to send
+func (r *keyring) current() *key {
+	return r.keys[0]
+}
+
+// lookup returns the key with the given id as long as it hasn't expired
+func (r *keyring) lookup(id string) (*key, error) {
+	for _, k := range r.keys {
+		if k.id != id {
+			continue
+		}
+		if !k.notAfter.IsZero() && time.Now().After(k.notAfter) {
+			return nil, fmt.Errorf("key %s expired on %s", id, k.notAfter.Format(time.RFC3339))
+		}
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %s", id)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeyring writes the key file content to a temporary file and loads it
+func testKeyring(t *testing.T, content string) (*keyring, error) {
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return newKeyring("", file)
+}
+
+func TestNewKeyring(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	for _, c := range []struct {
+		name    string
+		content string
+		// ids are the ids of the keys in order, err a part of the error when loading fails
+		ids []string
+		err string
+	}{
+		{name: "single key", content: "2026-10 correct-horse-battery-staple\n", ids: []string{"2026-10"}},
+		{name: "comments and blank lines", content: "# id passphrase [not-after]\n\n2026-10 new\n  # old key\n2026-09 old " + future + "\n",
+			ids: []string{"2026-10", "2026-09"}},
+		{name: "empty", content: "# no key yet\n", err: "no key found"},
+		{name: "passphrase missing", content: "2026-10\n", err: "keys:1: expected id"},
+		{name: "too many fields", content: "2026-10 new " + future + " extra\n", err: "keys:1: expected id"},
+		{name: "incorrect not-after", content: "2026-10 new\n2026-09 old 2026-11-01\n", err: "keys:2:"},
+		{name: "expiring first key", content: "# first\n2026-10 new " + future + "\n", err: "keys:2: the first key is used to send"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := testKeyring(t, c.content)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got %v, want an error containing %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, k := range r.keys {
+				ids = append(ids, k.id)
+			}
+			if !reflect.DeepEqual(ids, c.ids) {
+				t.Errorf("keys %v, want %v", ids, c.ids)
+			}
+			if r.current().id != c.ids[0] {
+				t.Errorf("sending with %s, want %s", r.current().id, c.ids[0])
+			}
+		})
+	}
+}
+
+// TestKeyRotation sends heartbeats between nodes whose key files are at different stages of a rotation
+func TestKeyRotation(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	for _, c := range []struct {
+		name     string
+		sender   string
+		receiver string
+		// reason is the reason of the packetError, empty when the heartbeat is accepted
+		reason string
+	}{
+		{name: "new key rolled out", sender: "old pass-old\n", receiver: "old pass-old\nnew pass-new\n"},
+		{name: "new key in use", sender: "new pass-new\n", receiver: "old pass-old\nnew pass-new\n"},
+		{name: "old key until it expires", sender: "old pass-old\n", receiver: "new pass-new\nold pass-old " + future + "\n"},
+		{name: "old key expired", sender: "old pass-old\n", receiver: "new pass-new\nold pass-old " + past + "\n", reason: "key"},
+		{name: "key not rolled out", sender: "new pass-new\n", receiver: "old pass-old\n", reason: "key"},
+		{name: "same id, other passphrase", sender: "new pass-other\n", receiver: "new pass-new\n", reason: "checksum"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tx, err := testKeyring(t, c.sender)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rx, err := testKeyring(t, c.receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := newAuthenticator(tx)
+			b, err := encodePacket(testPacket(a), a, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = decodePacket(b, newAuthenticator(rx), "10.77.0.2")
+			switch {
+			case c.reason == "" && err != nil:
+				t.Errorf("heartbeat dropped: %v", err)
+			case c.reason != "" && !isPacketError(err, c.reason):
+				t.Errorf("got %v, want a %s error", err, c.reason)
+			}
+		})
+	}
+}
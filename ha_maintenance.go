@@ -0,0 +1,83 @@
+// Maintenance mode. A node in maintenance keeps sending heartbeats and reports its state but never starts or stops anything,
+// e.g. during a patch window. It tells its peers with the maintenance flag of its heartbeats (see ha_wire.go), they don't treat it
+// as failed while it is silent, don't fence it and don't take the services over from it, see ha_cluster.go.
+// Maintenance is persistent: it is on as long as the maintenance file exists, which survives restarts of the daemon and reboots.
+// It is turned on and off with hactl maintenance on|off, SIGUSR1 and SIGUSR2 (every instance of the daemon), or by creating and
+// removing the file, which is checked on every round. {instance} in the name of the file is replaced with the instance id.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultMaintenanceFile is the maintenance file of an instance unless the flags or the configuration file give another one
+const defaultMaintenanceFile = "/var/lib/systemd-services-HA/maintenance-{instance}"
+
+// maintenancePath returns the maintenance file of the instance, empty when maintenance is not persistent
+func maintenancePath(file string, instance int) string {
+	return strings.ReplaceAll(file, "{instance}", strconv.Itoa(instance))
+}
+
+// setMaintenance suspends or resumes the transitions and creates or removes the maintenance file accordingly
+func (n *node) setMaintenance(on bool) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.maintenanceFile != "" {
+		var err error
+		if on {
+			if err = os.MkdirAll(filepath.Dir(n.maintenanceFile), 0755); err == nil {
+				err = os.WriteFile(n.maintenanceFile, nil, 0644)
+			}
+		} else if err = os.Remove(n.maintenanceFile); errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if on != n.maintenance {
+		log.Println("maintenance mode:", on)
+	}
+	n.maintenance = on
+	return nil
+}
+
+// syncMaintenance follows the maintenance file, it may have been created or removed by hand
+func (n *node) syncMaintenance() {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.maintenanceFile == "" {
+		return
+	}
+	_, err := os.Stat(n.maintenanceFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println("maintenance file:", err)
+		return
+	}
+	if on := err == nil; on != n.maintenance {
+		log.Println("maintenance mode:", on, "from", n.maintenanceFile)
+		n.maintenance = on
+	}
+}
+
+// watchMaintenance turns maintenance on for every instance on SIGUSR1 and off on SIGUSR2. It never returns.
+func (d *daemon) watchMaintenance() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	for s := range c {
+		for _, n := range d.list() {
+			if err := n.setMaintenance(s == syscall.SIGUSR1); err != nil {
+				log.Println("maintenance mode not changed:", err)
+			}
+		}
+	}
+}
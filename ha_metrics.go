@@ -0,0 +1,217 @@
+// Prometheus metrics of the daemon, served in the text exposition format on /metrics.
+// The metrics of a node carry its instance id in the ha_instance label, instance is already used by prometheus for the target.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// counters are the monotonic counters of a node, the heartbeat errors are counted by the daemon. The zero value is ready to use.
+type counters struct {
+	m               sync.Mutex
+	transitions     map[string]int
+	failovers       int
+	heartbeatErrors map[string]int
+	unitErrors      map[string]int
+}
+
+// transition counts t, failover tells whether a peer ran the services before, so that taking them over at startup isn't a failover
+func (c *counters) transition(t transition, failover bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.transitions == nil {
+		c.transitions = make(map[string]int)
+	}
+	c.transitions[fmt.Sprintf("from=%q,to=%q", t.From, t.To)]++
+	if t.To == stateMaster && failover {
+		c.failovers++
+	}
+}
+
+// countTransition counts the transitions of the node, becoming master is a failover once a peer ran the services
+func (n *node) countTransition(t transition) {
+	n.stats.transition(t, n.members.hadMaster())
+}
+
+// heartbeatError counts a heartbeat that was dropped, reason is the reason of a packetError
+func (c *counters) heartbeatError(reason string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.heartbeatErrors == nil {
+		c.heartbeatErrors = make(map[string]int)
+	}
+	c.heartbeatErrors[fmt.Sprintf("reason=%q", reason)]++
+}
+
+func (c *counters) unitError(unit, action string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.unitErrors == nil {
+		c.unitErrors = make(map[string]int)
+	}
+	c.unitErrors[fmt.Sprintf("unit=%q,action=%q", unit, action)]++
+}
+
+// copy returns a copy of the counters, written to the scrapers without holding the lock
+func (c *counters) copy() *counters {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return &counters{
+		transitions:     copyCounts(c.transitions),
+		failovers:       c.failovers,
+		heartbeatErrors: copyCounts(c.heartbeatErrors),
+		unitErrors:      copyCounts(c.unitErrors),
+	}
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	c := make(map[string]int, len(counts))
+	for k, v := range counts {
+		c[k] = v
+	}
+	return c
+}
+
+// serveMetrics listens on addr for prometheus scrapes
+func (d *daemon) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.writeMetrics(w)
+	})
+	log.Println("metrics listening at", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("metrics:", err)
+		}
+	}()
+}
+
+// writeMetrics writes every metric once with the samples of all the nodes, the exposition format doesn't allow a metric to repeat
+func (d *daemon) writeMetrics(w io.Writer) {
+	now := time.Now()
+	nodes := d.list()
+
+	metric(w, "ha_state", "gauge", "Current state of the node, 1 for the state it is in.")
+	for _, n := range nodes {
+		state := n.fsm.current()
+		for _, s := range []haState{stateInit, stateBackup, stateMaster, stateFault} {
+			value := 0
+			if s == state {
+				value = 1
+			}
+			fmt.Fprintf(w, "ha_state{%s,state=%q} %d\n", n.label(), s, value)
+		}
+	}
+	metric(w, "ha_priority", "gauge", "Configured priority of the node.")
+	for _, n := range nodes {
+		n.m.Lock()
+		priority := n.priority
+		n.m.Unlock()
+		fmt.Fprintf(w, "ha_priority{%s} %d\n", n.label(), priority)
+	}
+	metric(w, "ha_effective_priority", "gauge", "Priority advertised in heartbeats after health probes and overrides.")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "ha_effective_priority{%s} %d\n", n.label(), n.advertised())
+	}
+
+	metric(w, "ha_flap_hold", "gauge", "Whether the node holds its role because it changed too often.")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "ha_flap_hold{%s} %d\n", n.label(), boolValue(!n.flaps.since().IsZero()))
+	}
+
+	metric(w, "ha_track_failed", "gauge", "Whether the tracked interface or script failed.")
+	for _, n := range nodes {
+		for _, t := range n.tracking.status() {
+			fmt.Fprintf(w, "ha_track_failed{%s,type=%q,target=%q} %d\n", n.label(), t.Type, t.Target, boolValue(t.Failed))
+		}
+	}
+
+	peers := make([][]peerStatus, len(nodes))
+	for i, n := range nodes {
+		peers[i] = n.members.snapshot(now)
+	}
+	metric(w, "ha_peer_alive", "gauge", "Whether the peer has been heard from within the dead interval.")
+	for i, n := range nodes {
+		for _, p := range peers[i] {
+			fmt.Fprintf(w, "ha_peer_alive{%s,peer=%q} %d\n", n.label(), p.Address, boolValue(p.Alive))
+		}
+	}
+	metric(w, "ha_peer_heartbeat_age_seconds", "gauge", "Time since the last heartbeat of the peer.")
+	for i, n := range nodes {
+		for _, p := range peers[i] {
+			if p.LastHeartbeat != nil {
+				fmt.Fprintf(w, "ha_peer_heartbeat_age_seconds{%s,peer=%q} %g\n", n.label(), p.Address, now.Sub(*p.LastHeartbeat).Seconds())
+			}
+		}
+	}
+	metric(w, "ha_service_active", "gauge", "Whether the unit is active.")
+	for _, n := range nodes {
+		for _, s := range n.services {
+			active, err := n.units.isActive(s)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "ha_service_active{%s,service=%q} %d\n", n.label(), s, boolValue(active))
+		}
+	}
+
+	// a slow scraper must not hold up the transitions or the receive loop
+	stats := make([]*counters, len(nodes))
+	for i, n := range nodes {
+		stats[i] = n.stats.copy()
+	}
+	metric(w, "ha_failovers_total", "counter", "Number of times this node took the services over once a peer had run them.")
+	for i, n := range nodes {
+		fmt.Fprintf(w, "ha_failovers_total{%s} %d\n", n.label(), stats[i].failovers)
+	}
+	metric(w, "ha_transitions_total", "counter", "Number of state transitions.")
+	for i, n := range nodes {
+		writeLabeled(w, "ha_transitions_total", n.label(), stats[i].transitions)
+	}
+	metric(w, "ha_heartbeat_errors_total", "counter", "Number of heartbeats dropped, by reason (format, auth, key, checksum, decrypt, replay).")
+	writeLabeled(w, "ha_heartbeat_errors_total", "", d.stats.copy().heartbeatErrors)
+	metric(w, "ha_unit_errors_total", "counter", "Number of failed start and stop jobs.")
+	for i, n := range nodes {
+		writeLabeled(w, "ha_unit_errors_total", n.label(), stats[i].unitErrors)
+	}
+}
+
+// label returns the label of the metrics of the node
+func (n *node) label() string {
+	return fmt.Sprintf("ha_instance=\"%d\"", n.instance)
+}
+
+func metric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeLabeled writes the values by label, prefixed with the labels in prefix when it isn't empty
+func writeLabeled(w io.Writer, name, prefix string, values map[string]int) {
+	labels := make([]string, 0, len(values))
+	for l := range values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		if prefix != "" {
+			fmt.Fprintf(w, "%s{%s,%s} %d\n", name, prefix, l, values[l])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, l, values[l])
+		}
+	}
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,472 @@
+// A node of a service group. It ties the election, health probes, witness, fencing, virtual ip addresses and units to the state machine.
+// The daemons only exchange heartbeats, feed them to the cluster and call step on every round.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxPriority is advertised by a node promoted by the operator
+const maxPriority = 255
+
+type node struct {
+	instance int
+	host     string
+	services []string
+	priority int
+	members  *cluster
+	health   *health
+	tracking *tracker
+	quorum   witness
+	fencing  *fencer
+	units    unitManager
+	addrs    *vip
+	fsm      *stateMachine
+	auth     *authenticator
+	flaps    *damper
+	notify   *notifier
+	stats    counters
+
+	// round is held by a round of the election and by shutdown, which sets stopping to end the election
+	round    sync.Mutex
+	stopping bool
+
+	m           sync.Mutex
+	override    string
+	maintenance bool
+	// maintenanceFile keeps maintenance on across restarts, see ha_maintenance.go
+	maintenanceFile string
+	frozen          bool
+	handover        net.IP
+	// takeover is set while this node is promoted because a master handed its services over to it, see followHandover
+	takeover bool
+	// advert is the interval between heartbeats, failback how long this node waits before taking the services over from a live master
+	advert       time.Duration
+	failback     time.Duration
+	preemptSince time.Time
+	// nopreempt keeps a live master in place even when a node with a higher priority comes back, see holdRole
+	nopreempt bool
+	// steps are the services in start order, see ha_steps.go
+	steps []step
+	// onShutdown is stop or keep, resigned is set once the services stopped on shutdown, see ha_shutdown.go
+	onShutdown string
+	resigned   bool
+	// restored is set when the node resumed the master role after a restart, see ha_persist.go
+	restored bool
+	// due is when the election must have run its next round, the watchdog of systemd isn't pinged anymore past it, see ha_sdnotify.go
+	due time.Time
+	// seen tells whether the peers heard from so far were alive in the last round
+	seen map[string]bool
+}
+
+// checkTimers validates the timers, deadAdverts is the number of missed heartbeats after which a peer is dead
+func checkTimers(advert time.Duration, deadAdverts int, failback time.Duration) error {
+	if advert <= 0 {
+		return fmt.Errorf("Incorrect advert interval %s", advert)
+	}
+	if deadAdverts < 2 {
+		return fmt.Errorf("Incorrect dead interval of %d adverts, at least 2 are needed", deadAdverts)
+	}
+	if failback < 0 {
+		return fmt.Errorf("Incorrect failback delay %s", failback)
+	}
+	return nil
+}
+
+// setTimers changes the timers of a running node
+func (n *node) setTimers(advert time.Duration, deadAdverts int, failback time.Duration) {
+	n.m.Lock()
+	n.advert = advert
+	n.failback = failback
+	n.m.Unlock()
+	n.members.setDead(advert * time.Duration(deadAdverts))
+}
+
+// interval returns the time between two heartbeats
+func (n *node) interval() time.Duration {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.advert
+}
+
+// start runs the health probes and follows the state of the units
+func (n *node) start() {
+	n.expect(n.interval())
+	n.fsm.onTransition(n.countTransition)
+	n.fsm.onTransition(n.flaps.record)
+	n.notify.start()
+	n.fsm.onTransition(n.notify.transition)
+	go n.health.run()
+	go n.tracking.run()
+	changes, err := n.units.watch(n.services)
+	if err != nil {
+		log.Println("unable to watch the services:", err)
+		return
+	}
+	go n.health.watchUnits(changes)
+}
+
+// effective returns the priority to advertise and whether the node should hand the services over to a live peer.
+// The weights of the failed tracked items (ha_track.go) and health probes (ha_probe.go) are subtracted from the priority. The operator can demote the node, which hands the services over, or promote it, which advertises maxPriority.
+// A frozen or held master (see ha_flap.go) advertises maxPriority as long as it is healthy so that no peer takes over.
+func (n *node) effective() (int, bool) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	priority, down := n.tracking.effective(n.priority)
+	p, fault := n.health.effective(priority)
+	fault = fault || down
+	switch n.override {
+	case "demote":
+		return 1, true
+	case "promote":
+		return maxPriority, false
+	}
+	if (n.frozen || n.flaps.held(time.Now())) && !fault && n.fsm.current() == stateMaster {
+		return maxPriority, false
+	}
+	return p, fault
+}
+
+// advertised returns the effective priority to send in heartbeats
+func (n *node) advertised() int {
+	p, _ := n.effective()
+	return p
+}
+
+// setOverride sets the operator override, one of "demote", "promote" or "" to follow the election again. It ends a switchover.
+func (n *node) setOverride(override string) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if override != n.override {
+		log.Printf("operator override set to %q", override)
+	}
+	n.override = override
+	n.handover = nil
+	n.takeover = false
+}
+
+// setFrozen keeps the current master in place, a failing master still fails over
+func (n *node) setFrozen(on bool) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if on != n.frozen {
+		log.Println("frozen:", on)
+	}
+	n.frozen = on
+}
+
+// switchover hands the services over to the live peer with the ip address to. The peer is told in the heartbeats and promotes itself,
+// this node keeps the services until then so that no other peer takes them over meanwhile, and stays demoted afterwards.
+func (n *node) switchover(to string) error {
+	ip := net.ParseIP(to)
+	if host, _, err := net.SplitHostPort(to); err == nil {
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return fmt.Errorf("incorrect ip address %s", to)
+	}
+	if n.fsm.current() != stateMaster {
+		return fmt.Errorf("this node is not master")
+	}
+	found := false
+	for _, p := range n.members.snapshot(time.Now()) {
+		if addr, _ := net.ResolveUDPAddr("udp", p.Address); addr != nil && addr.IP.Equal(ip) && p.Alive && p.Compatible {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s is not a live peer", to)
+	}
+	log.Println("switching over to", ip)
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.handover = ip
+	return nil
+}
+
+// handoverTarget returns the ip address this node hands its services over to, empty when there is no switchover in progress
+func (n *node) handoverTarget() string {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.handover == nil {
+		return ""
+	}
+	return n.handover.String()
+}
+
+// watchPeers notifies the peers lost or regained since the last round. Peers never heard from are not reported.
+func (n *node) watchPeers(now time.Time) {
+	peers := n.members.snapshot(now)
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.seen == nil {
+		n.seen = make(map[string]bool)
+	}
+	for _, p := range peers {
+		alive, known := n.seen[p.Address]
+		switch {
+		case known && alive && !p.Alive:
+			log.Println("peer", p.Address, "lost")
+			n.notify.notify(event{Event: "peer_lost", Peer: p.Address})
+		case known && !alive && p.Alive:
+			n.notify.notify(event{Event: "peer_regained", Peer: p.Address})
+		}
+		if known || p.Alive {
+			n.seen[p.Address] = p.Alive
+		}
+	}
+}
+
+// followHandover runs both ends of a switchover.
+// The target promotes itself when a live peer hands its services over to it and stays promoted until the operator runs hactl auto, so
+// that a peer with a higher priority doesn't take the services back, or until it fails to run them.
+// The master demotes itself once the target advertises its promotion and ends the switchover once the target is master, it stays demoted
+// until the operator lets it take the services back, e.g. once it is patched. The switchover is abandoned when the target dies first.
+func (n *node) followHandover(now time.Time) {
+	peers := n.members.snapshot(now)
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.takeover && n.fsm.current() == stateFault {
+		n.takeover = false
+		n.override = ""
+	}
+	for _, p := range peers {
+		addr, err := net.ResolveUDPAddr("udp", p.Address)
+		if err != nil {
+			continue
+		}
+		if n.handover != nil && addr.IP.Equal(n.handover) {
+			switch {
+			case !p.Alive:
+				log.Println("switchover to", n.handover, "abandoned, the peer is gone")
+				n.handover = nil
+				n.override = ""
+			case p.Alive && p.State == stateMaster.String():
+				log.Println("switchover to", n.handover, "complete, demoted until hactl auto")
+				n.handover = nil
+			case p.Alive && p.Priority == maxPriority && n.override != "demote":
+				log.Println(n.handover, "is promoted, handing the services over")
+				n.override = "demote"
+			}
+		}
+		if current := n.fsm.current(); p.Alive && p.Handover != "" && !n.takeover && (current == stateInit || current == stateBackup) &&
+			isLocalIP(net.ParseIP(p.Handover)) {
+			log.Println(p.Address, "hands its services over to this node")
+			n.override = "promote"
+			n.takeover = true
+		}
+	}
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil || ip == nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *node) inMaintenance() bool {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.maintenance
+}
+
+// decide returns the state this node should be in and why
+func (n *node) decide(now time.Time) (haState, string) {
+	if !n.members.settled(now) {
+		return stateInit, "waiting for peers"
+	}
+	master, conflict := n.members.elect(now)
+	if conflict {
+		return stateFault, "a peer runs a different configuration"
+	}
+	if n.members.maintenanceMaster(now) {
+		return stateBackup, "the master is in maintenance"
+	}
+	if tookOver, waiting := n.reconcile(now); waiting {
+		return stateInit, "waiting for the peers to resume"
+	} else if tookOver {
+		return stateBackup, "a peer took the services over while this node was down"
+	}
+	n.m.Lock()
+	takeover := n.takeover
+	n.m.Unlock()
+	// the master demotes itself once it sees the promotion, the services only run on one node at a time
+	if takeover && n.fsm.current() != stateMaster && n.members.masterAlive(now) {
+		return stateBackup, "waiting for the master to hand its services over"
+	}
+	if state, ok := n.holdRole(now); ok {
+		if state == stateBackup {
+			return stateBackup, "nopreempt, a live master keeps the services"
+		}
+		master = true
+	}
+	if n.delayFailback(master, now) {
+		return stateBackup, "waiting for the failback delay"
+	}
+	if !master {
+		return stateBackup, "a peer has a higher priority"
+	}
+	n.m.Lock()
+	quorum := n.quorum
+	n.m.Unlock()
+	// the master keeps renewing its vote but only needs it while some peers are missing
+	if quorum != nil && !quorum.vote(n.interval()) && !n.members.complete(now) {
+		return stateBackup, "no vote from the witness"
+	}
+	return stateMaster, "highest priority live node"
+}
+
+// holdRole keeps the current role in nopreempt mode: a master keeps the services until it fails, is demoted or meets another master,
+// which the election then settles, and the other nodes don't take them over. A promoted node takes them over anyway.
+func (n *node) holdRole(now time.Time) (haState, bool) {
+	_, fault := n.effective()
+	n.m.Lock()
+	nopreempt, promoted := n.nopreempt, n.override == "promote"
+	n.m.Unlock()
+	if !nopreempt || promoted {
+		return stateInit, false
+	}
+	otherMaster := n.members.masterAlive(now)
+	switch current := n.fsm.current(); {
+	case current == stateMaster && !fault && !otherMaster:
+		return stateMaster, true
+	case current != stateMaster && otherMaster:
+		return stateBackup, true
+	}
+	return stateInit, false
+}
+
+// delayFailback reports whether this node has to wait before taking the services over from a live master (preempt delay).
+// The delay starts when this node wins the election and starts over whenever it doesn't, e.g. while it is unhealthy,
+// so a recovered node only takes over once it has been healthy for the whole delay. A promoted node doesn't wait.
+func (n *node) delayFailback(master bool, now time.Time) bool {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if !master || n.failback == 0 || n.override == "promote" || n.fsm.current() == stateMaster || !n.members.masterAlive(now) {
+		n.preemptSince = time.Time{}
+		return false
+	}
+	if n.preemptSince.IsZero() {
+		log.Println("taking the services over from the master in", n.failback)
+		n.preemptSince = now
+	}
+	return now.Sub(n.preemptSince) < n.failback
+}
+
+// step runs one round of the election and moves the state machine accordingly
+func (n *node) step(now time.Time) {
+	n.round.Lock()
+	defer n.round.Unlock()
+	n.expect(0)
+	defer func() { n.expect(n.interval()) }()
+	if n.stopping {
+		return
+	}
+	n.syncMaintenance()
+	n.watchPeers(now)
+	n.followHandover(now)
+	n.members.setPriority(n.effective())
+	if n.inMaintenance() {
+		return
+	}
+	target, reason := n.decide(now)
+	current := n.fsm.current()
+	if target == current || target == stateInit {
+		return
+	}
+	if n.flaps.held(now) && !n.failover(current, target, now) {
+		return
+	}
+	if target == stateMaster && current != stateBackup {
+		// INIT and FAULT pass through BACKUP, the services are about to start so they are left alone
+		if err := n.fsm.transition(stateBackup, reason); err != nil {
+			log.Println(err)
+			return
+		}
+		if !n.enter(target, reason, now) {
+			n.toggle(false)
+		}
+		return
+	}
+	n.enter(target, reason, now)
+}
+
+// failover reports whether a node held by the flap damping moves from current to target anyway: a backup takes the services over
+// when no live master runs them, a master in fault gives them up and a conflict stops them. Other changes wait for the end of the hold.
+func (n *node) failover(current, target haState, now time.Time) bool {
+	switch {
+	case target == stateFault:
+		return true
+	case current == stateMaster:
+		_, fault := n.effective()
+		return fault
+	case target == stateMaster:
+		return !n.members.masterAlive(now)
+	}
+	return true
+}
+
+// enter moves to the state to and starts or stops the services. It returns false when the node stays where it is.
+func (n *node) enter(to haState, reason string, now time.Time) bool {
+	if to == stateMaster {
+		n.m.Lock()
+		fencing := n.fencing
+		n.m.Unlock()
+		// make sure the silent peers don't run the services anymore
+		if err := fencing.fence(n.members.missing(now), n.expect); err != nil {
+			log.Println("ALERT:", err, "staying passive")
+			return false
+		}
+	}
+	if err := n.fsm.transition(to, reason); err != nil {
+		log.Println(err)
+		return false
+	}
+	// a node that can't start or stop its services is in fault, the next rounds try again
+	if err := n.toggle(to == stateMaster); err != nil && to != stateFault {
+		if err := n.fsm.transition(stateFault, err.Error()); err != nil {
+			log.Println(err)
+		}
+	}
+	return true
+}
+
+// toggle starts or stops the services in the order of their steps, see ha_steps.go.
+// The virtual ip addresses are brought up before the first step starts and removed after the last one stopped.
+func (n *node) toggle(on bool) error {
+	n.m.Lock()
+	steps := n.steps
+	n.m.Unlock()
+	if on {
+		if err := n.addrs.up(); err != nil {
+			log.Println(err)
+		}
+		if err := n.startSteps(steps); err != nil {
+			if err := n.addrs.down(); err != nil {
+				log.Println(err)
+			}
+			n.health.setActive(false)
+			return err
+		}
+		n.health.setActive(true)
+		return nil
+	}
+	err := n.stopSteps(steps)
+	if err := n.addrs.down(); err != nil {
+		log.Println(err)
+	}
+	n.health.setActive(false)
+	return err
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeUnits is a unitManager that records the jobs instead of running them, the units in fail fail to start
+type fakeUnits struct {
+	jobs   []string
+	active map[string]bool
+	fail   map[string]bool
+}
+
+func (f *fakeUnits) start(name string, timeout time.Duration) error {
+	f.jobs = append(f.jobs, "start "+name)
+	if f.fail[name] {
+		return fmt.Errorf("%s failed to start", name)
+	}
+	f.active[name] = true
+	return nil
+}
+
+func (f *fakeUnits) stop(name string, timeout time.Duration) error {
+	f.jobs = append(f.jobs, "stop "+name)
+	f.active[name] = false
+	return nil
+}
+
+func (f *fakeUnits) isActive(name string) (bool, error) {
+	return f.active[name], nil
+}
+
+func (f *fakeUnits) watch(names []string) (<-chan unitState, error) {
+	return make(chan unitState), nil
+}
+
+const (
+	testPeer  = "10.77.0.3:9000"
+	testThird = "10.77.0.4:9000"
+)
+
+// testNode returns a node with the peers, the services a and b and no probes, fencing, witness or virtual ip address
+func testNode(t *testing.T, priority int, units *fakeUnits, peers ...string) *node {
+	steps, services, err := parseSteps([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []*net.UDPAddr
+	for _, p := range peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, addr)
+	}
+	h, err := newHealth(nil, services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fencing, err := newFencer(nil, services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vip, err := newVIP(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaps, err := newDamper(0, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify, err := newNotifier(nil, services, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &node{
+		instance: 10,
+		services: services,
+		priority: priority,
+		members:  newCluster(addrs, priority, time.Second),
+		health:   h,
+		tracking: &tracker{},
+		fencing:  fencing,
+		units:    units,
+		addrs:    vip,
+		fsm:      newStateMachine(),
+		flaps:    flaps,
+		notify:   notify,
+		steps:    steps,
+		advert:   time.Millisecond * 200,
+	}
+}
+
+func TestStep(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		from haState
+		// peer and third are the heartbeats of the peers, nil when they have never been heard from
+		peer  *heartbeat
+		third *heartbeat
+		// settled is false while the peer still has its first dead interval to show up
+		settled bool
+		fail    map[string]bool
+		want    haState
+		jobs    []string
+		// failover is set when becoming master counts as a failover
+		failover bool
+	}{
+		{
+			name: "waiting for the peer",
+			from: stateInit,
+			want: stateInit,
+		},
+		{
+			name:    "peer never showed up",
+			from:    stateInit,
+			settled: true,
+			want:    stateMaster,
+			jobs:    []string{"start a", "start b"},
+		},
+		{
+			name:    "peer with a higher priority",
+			from:    stateInit,
+			peer:    &heartbeat{priority: 150, state: "MASTER", compatible: true},
+			settled: true,
+			want:    stateBackup,
+			jobs:    []string{"stop b", "stop a"},
+		},
+		{
+			name:    "peer with a lower priority",
+			from:    stateBackup,
+			peer:    &heartbeat{priority: 50, state: "BACKUP", compatible: true},
+			settled: true,
+			want:    stateMaster,
+			jobs:    []string{"start a", "start b"},
+		},
+		{
+			name:    "master meets a higher priority",
+			from:    stateMaster,
+			peer:    &heartbeat{priority: 150, state: "BACKUP", compatible: true},
+			settled: true,
+			want:    stateBackup,
+			jobs:    []string{"stop b", "stop a"},
+		},
+		{
+			name:     "peer in fault",
+			from:     stateBackup,
+			peer:     &heartbeat{priority: 150, state: "MASTER", fault: true, compatible: true},
+			settled:  true,
+			want:     stateMaster,
+			jobs:     []string{"start a", "start b"},
+			failover: true,
+		},
+		{
+			name:    "peer in maintenance",
+			from:    stateBackup,
+			peer:    &heartbeat{priority: 150, state: "BACKUP", maintenance: true, compatible: true},
+			settled: true,
+			want:    stateMaster,
+			jobs:    []string{"start a", "start b"},
+		},
+		{
+			name:    "incompatible peer",
+			from:    stateMaster,
+			peer:    &heartbeat{priority: 50, state: "BACKUP"},
+			settled: true,
+			want:    stateFault,
+			jobs:    []string{"stop b", "stop a"},
+		},
+		{
+			name:    "switchover to a lower priority than a third node",
+			from:    stateBackup,
+			peer:    &heartbeat{priority: 1, state: "BACKUP", handover: "127.0.0.1", fault: true, compatible: true},
+			third:   &heartbeat{priority: 150, state: "BACKUP", compatible: true},
+			settled: true,
+			want:    stateMaster,
+			jobs:    []string{"start a", "start b"},
+		},
+		{
+			name:    "service fails to start",
+			from:    stateBackup,
+			settled: true,
+			fail:    map[string]bool{"b": true},
+			want:    stateFault,
+			jobs:    []string{"start a", "start b", "stop b", "stop a"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			units := &fakeUnits{active: make(map[string]bool), fail: c.fail}
+			n := testNode(t, 100, units, testPeer, testThird)
+			n.fsm.state = c.from
+			n.fsm.onTransition(n.countTransition)
+			if c.settled {
+				n.members.started = time.Now().Add(-time.Minute)
+			}
+			for addr, hb := range map[string]*heartbeat{testPeer: c.peer, testThird: c.third} {
+				if hb != nil {
+					peer, _ := net.ResolveUDPAddr("udp", addr)
+					n.members.observe(peer.IP, *hb)
+				}
+			}
+			n.step(time.Now())
+			if got := n.fsm.current(); got != c.want {
+				t.Errorf("state is %s, want %s", got, c.want)
+			}
+			if !reflect.DeepEqual(units.jobs, c.jobs) {
+				t.Errorf("jobs %v, want %v", units.jobs, c.jobs)
+			}
+			if failover := n.stats.copy().failovers > 0; failover != c.failover {
+				t.Errorf("failover counted: %t, want %t", failover, c.failover)
+			}
+		})
+	}
+}
+
+// heartbeatOf returns the heartbeat a peer receives from n
+func heartbeatOf(n *node) heartbeat {
+	p := n.nextPacket()
+	return heartbeat{priority: p.priority, state: p.role.String(), handover: p.handover, fault: p.fault, compatible: true}
+}
+
+// TestSwitchover hands the services of a master over to a peer with a lower priority than a third node, which must not get them
+func TestSwitchover(t *testing.T) {
+	master := testNode(t, 100, &fakeUnits{active: map[string]bool{"a": true, "b": true}}, "127.0.0.1:9000", testThird)
+	master.fsm.state = stateMaster
+	// in nopreempt mode, the third node leaves the services to the master
+	master.nopreempt = true
+	targetUnits := &fakeUnits{active: make(map[string]bool)}
+	target := testNode(t, 50, targetUnits, testPeer, testThird)
+	target.fsm.state = stateBackup
+	third := heartbeat{priority: 150, state: "BACKUP", compatible: true}
+	masterIP, targetIP, thirdIP := net.ParseIP("10.77.0.3"), net.ParseIP("127.0.0.1"), net.ParseIP("10.77.0.4")
+	round := func() {
+		master.members.observe(targetIP, heartbeatOf(target))
+		master.members.observe(thirdIP, third)
+		target.members.observe(masterIP, heartbeatOf(master))
+		target.members.observe(thirdIP, third)
+		master.step(time.Now())
+		target.step(time.Now())
+	}
+	for _, n := range []*node{master, target} {
+		n.members.started = time.Now().Add(-time.Minute)
+	}
+	round()
+	if err := master.switchover("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		round()
+		// the master keeps the services until the target is promoted
+		if master.fsm.current() == stateMaster && target.fsm.current() == stateMaster {
+			t.Fatalf("round %d: both nodes are master", i)
+		}
+	}
+	if master.fsm.current() != stateBackup || target.fsm.current() != stateMaster {
+		t.Fatalf("master is %s and target %s, want BACKUP and MASTER", master.fsm.current(), target.fsm.current())
+	}
+	if master.handoverTarget() != "" || master.override != "demote" {
+		t.Errorf("master hands over to %q with the override %q, want the switchover complete and the master demoted",
+			master.handoverTarget(), master.override)
+	}
+	// the third node doesn't preempt the target
+	if hb := heartbeatOf(target); hb.priority <= third.priority {
+		t.Errorf("target advertises %d, less than the third node", hb.priority)
+	}
+	if !reflect.DeepEqual(targetUnits.jobs, []string{"start a", "start b"}) {
+		t.Errorf("target jobs %v", targetUnits.jobs)
+	}
+	target.setOverride("")
+	if hb := heartbeatOf(target); hb.priority != 50 {
+		t.Errorf("target advertises %d after hactl auto, want 50", hb.priority)
+	}
+}
@@ -0,0 +1,213 @@
+// Notifications of the transitions of the state machine and of peers lost or regained.
+// A hook is given as a comma separated list of key=value, e.g.
+// type=exec,target=/etc/scripts/notify.sh     runs the script with HA_EVENT, HA_FROM, HA_TO, HA_REASON, HA_PEER, HA_HOST, HA_INSTANCE and HA_SERVICES in its environment
+// type=http,target=https://hooks.example.com/ha posts the event as json
+// type=syslog,target=systemd-services-HA     logs the event to syslog with the target as tag
+// Every hook has its own queue and runs in the background, a slow hook never delays the election. Events are dropped when a queue is full.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyArray holds the repeated notification flag
+type notifyArray []string
+
+func (h *notifyArray) String() string {
+	return strings.Join(*h, " ")
+}
+func (h *notifyArray) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
+const (
+	notifyTimeout = time.Second * 10
+	notifyQueue   = 64
+)
+
+// event is sent to the hooks, Event is one of transition, peer_lost or peer_regained
+type event struct {
+	Event    string    `json:"event"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+	Host     string    `json:"host"`
+	Instance int       `json:"instance"`
+	Services []string  `json:"services"`
+	Time     time.Time `json:"time"`
+}
+
+type hook struct {
+	kind   string
+	target string
+	queue  chan event
+}
+
+type notifier struct {
+	m        sync.Mutex
+	hooks    []*hook
+	services []string
+	host     string
+	instance int
+}
+
+func parseHook(spec string) (*hook, error) {
+	h := &hook{}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("Incorrect notification %s", spec)
+		}
+		switch k {
+		case "type":
+			h.kind = v
+		case "target":
+			h.target = v
+		default:
+			return nil, fmt.Errorf("Incorrect notification %s: unknown key %s", spec, k)
+		}
+	}
+	switch h.kind {
+	case "exec", "http":
+		if h.target == "" {
+			return nil, fmt.Errorf("Incorrect notification %s: target is missing", spec)
+		}
+	case "syslog":
+		if h.target == "" {
+			h.target = "systemd-services-HA"
+		}
+	default:
+		return nil, fmt.Errorf("Incorrect notification %s: unknown type %s", spec, h.kind)
+	}
+	return h, nil
+}
+
+// newNotifier parses the hooks of an instance, they only run once the notifier is started
+func newNotifier(specs []string, services []string, instance int) (*notifier, error) {
+	n := &notifier{services: services, instance: instance}
+	n.host, _ = os.Hostname()
+	for _, s := range specs {
+		h, err := parseHook(s)
+		if err != nil {
+			return nil, err
+		}
+		n.hooks = append(n.hooks, h)
+	}
+	return n, nil
+}
+
+// start runs the hooks in the background
+func (n *notifier) start() {
+	n.m.Lock()
+	defer n.m.Unlock()
+	for _, h := range n.hooks {
+		h.start()
+	}
+}
+
+// set replaces the hooks with the ones of other, e.g. after the configuration changed. Events already queued are still delivered.
+func (n *notifier) set(other *notifier) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	for _, h := range n.hooks {
+		close(h.queue)
+	}
+	n.hooks = other.hooks
+	for _, h := range n.hooks {
+		h.start()
+	}
+}
+
+// notify queues the event for every hook, it never blocks
+func (n *notifier) notify(e event) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	e.Host = n.host
+	e.Instance = n.instance
+	e.Services = n.services
+	e.Time = time.Now()
+	for _, h := range n.hooks {
+		select {
+		case h.queue <- e:
+		default:
+			log.Printf("%s notification queue full, %s event dropped", h.kind, e.Event)
+		}
+	}
+}
+
+// transition notifies a transition of the state machine
+func (n *notifier) transition(t transition) {
+	n.notify(event{Event: "transition", From: t.From.String(), To: t.To.String(), Reason: t.Reason})
+}
+
+func (h *hook) start() {
+	h.queue = make(chan event, notifyQueue)
+	go func(queue chan event) {
+		for e := range queue {
+			if err := h.deliver(e); err != nil {
+				log.Printf("%s notification of %s failed: %v", h.kind, e.Event, err)
+			}
+		}
+	}(h.queue)
+}
+
+func (h *hook) deliver(e event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	switch h.kind {
+	case "exec":
+		cmd := exec.CommandContext(ctx, h.target)
+		cmd.Env = append(os.Environ(), "HA_EVENT="+e.Event, "HA_FROM="+e.From, "HA_TO="+e.To, "HA_REASON="+e.Reason,
+			"HA_PEER="+e.Peer, "HA_HOST="+e.Host, "HA_INSTANCE="+strconv.Itoa(e.Instance), "HA_SERVICES="+strings.Join(e.Services, " "))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+	case "http":
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_DAEMON, h.target)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		msg := e.Event
+		if e.Event == "transition" {
+			msg = fmt.Sprintf("%s -> %s: %s", e.From, e.To, e.Reason)
+		} else if e.Peer != "" {
+			msg += " " + e.Peer
+		}
+		return w.Notice(msg)
+	}
+	return nil
+}
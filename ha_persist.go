@@ -0,0 +1,284 @@
+// State kept across restarts of the daemon, e.g. when systemd restarts it after a crash.
+// The role of every instance, its operator overrides and flap hold, its last view of the peers and the sequence numbers of the
+// heartbeats are written to the state file on every transition and every stateSaveInterval.
+// On startup an instance that was master and whose units all still run resumes the master role without stopping or starting
+// anything, and keeps it unless a peer took the services over while the daemon was down. Its virtual ip addresses are only brought
+// up once every peer was heard from since the restart, or a dead interval passed, and none of them is master. Peers heard from within the dead interval
+// are known right away, so the election doesn't wait for them. An instance that wasn't master, or whose units don't all run,
+// starts over from INIT.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultStateFile is the state file unless the flags or the configuration file give another one
+const defaultStateFile = "/var/lib/systemd-services-HA/state.json"
+
+const stateSaveInterval = time.Second * 5
+
+type savedState struct {
+	Saved     time.Time             `json:"saved"`
+	Seq       uint64                `json:"seq,omitempty"`
+	LastSeq   map[string]uint64     `json:"last_seq,omitempty"`
+	Instances map[int]savedInstance `json:"instances"`
+}
+
+type savedInstance struct {
+	State     string      `json:"state"`
+	Since     time.Time   `json:"since"`
+	Override  string      `json:"override,omitempty"`
+	Frozen    bool        `json:"frozen,omitempty"`
+	HeldSince time.Time   `json:"held_since,omitempty"`
+	Peers     []savedPeer `json:"peers,omitempty"`
+}
+
+type savedPeer struct {
+	Address     string    `json:"address"`
+	Node        string    `json:"node,omitempty"`
+	State       string    `json:"state,omitempty"`
+	Priority    int       `json:"priority"`
+	Handover    string    `json:"handover,omitempty"`
+	Maintenance bool      `json:"maintenance,omitempty"`
+	Fault       bool      `json:"fault,omitempty"`
+	Compatible  bool      `json:"compatible"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// persist saves the state to path in the background, on every transition and every stateSaveInterval
+func (d *daemon) persist(path string) {
+	changed := make(chan struct{}, 1)
+	for _, n := range d.list() {
+		n.fsm.onTransition(func(transition) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}
+	go func() {
+		ticker := time.NewTicker(stateSaveInterval)
+		for {
+			if err := d.save(path); err != nil {
+				log.Println("unable to save the state:", err)
+			}
+			select {
+			case <-changed:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// save writes the state to a temporary file renamed over path, so that a crash never leaves half of it behind
+func (d *daemon) save(path string) error {
+	s := savedState{Saved: time.Now(), Instances: make(map[int]savedInstance)}
+	if d.auth != nil {
+		s.Seq, s.LastSeq = d.auth.sequences()
+	}
+	for _, n := range d.list() {
+		s.Instances[n.instance] = n.saved()
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (n *node) saved() savedInstance {
+	state, since := n.fsm.status()
+	n.m.Lock()
+	s := savedInstance{State: state.String(), Since: since, Override: n.override, Frozen: n.frozen}
+	// a restart ends a switchover in progress
+	if n.handover != nil || n.takeover {
+		s.Override = ""
+	}
+	n.m.Unlock()
+	s.HeldSince = n.flaps.since()
+	n.members.m.Lock()
+	defer n.members.m.Unlock()
+	for _, p := range n.members.peers {
+		if p.lastSeen.IsZero() {
+			continue
+		}
+		s.Peers = append(s.Peers, savedPeer{
+			Address:     p.addr.String(),
+			Node:        p.last.node,
+			State:       p.last.state,
+			Priority:    p.last.priority,
+			Handover:    p.last.handover,
+			Maintenance: p.last.maintenance,
+			Fault:       p.last.fault,
+			Compatible:  p.last.compatible,
+			LastSeen:    p.lastSeen,
+		})
+	}
+	return s
+}
+
+// restore reads the state saved by a previous run from path and reconciles it with the units, it must run before the nodes start.
+// A missing file is not an error.
+func (d *daemon) restore(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s savedState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if d.auth != nil {
+		d.auth.restoreSequences(s.Seq, s.LastSeq)
+	}
+	for id, saved := range s.Instances {
+		if n, ok := d.nodes[id]; ok {
+			n.restore(saved)
+		}
+	}
+	return nil
+}
+
+func (n *node) restore(s savedInstance) {
+	now := time.Now()
+	n.m.Lock()
+	n.override = s.Override
+	n.frozen = s.Frozen
+	n.m.Unlock()
+	if !s.HeldSince.IsZero() {
+		n.flaps.hold(s.HeldSince)
+	}
+	n.members.restore(s.Peers, now)
+	if s.State != stateMaster.String() {
+		return
+	}
+	for _, u := range n.services {
+		if active, err := n.units.isActive(u); err != nil || !active {
+			log.Printf("was master before the restart but %s doesn't run, starting over", u)
+			return
+		}
+	}
+	n.health.setActive(true)
+	n.fsm.restore(stateMaster, s.Since)
+	if n.inMaintenance() {
+		// the peers don't take the services over from a master in maintenance
+		if err := n.addrs.up(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	n.m.Lock()
+	n.restored = true
+	n.m.Unlock()
+}
+
+// heardSinceStart reports whether every peer has been heard from since startup or has had one dead interval to show up
+func (c *cluster) heardSinceStart(now time.Time) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if now.Sub(c.started) >= c.dead {
+		return true
+	}
+	for _, p := range c.peers {
+		if p.lastSeen.Before(c.started) {
+			return false
+		}
+	}
+	return true
+}
+
+// restore takes the peers saved by a previous run that were heard from within the dead interval
+func (c *cluster) restore(peers []savedPeer, now time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, s := range peers {
+		if now.Sub(s.LastSeen) >= c.dead && !s.Maintenance {
+			continue
+		}
+		for _, p := range c.peers {
+			if p.addr.String() != s.Address {
+				continue
+			}
+			p.lastSeen = s.LastSeen
+			p.last = heartbeat{priority: s.Priority, node: s.Node, state: s.State, handover: s.Handover,
+				maintenance: s.Maintenance, fault: s.Fault, compatible: s.Compatible}
+		}
+	}
+}
+
+// reconcile settles, once after a restart as master, whether a peer took the services over while this node was down. That peer then
+// keeps them, otherwise the virtual ip addresses are brought up. waiting is set until every peer was heard from since the restart
+// or a dead interval passed, the heartbeats saved before the restart don't tell.
+func (n *node) reconcile(now time.Time) (tookOver bool, waiting bool) {
+	n.m.Lock()
+	restored := n.restored
+	if restored && n.members.heardSinceStart(now) {
+		n.restored = false
+	}
+	waiting = n.restored
+	n.m.Unlock()
+	if !restored || waiting {
+		return false, waiting
+	}
+	for _, p := range n.members.snapshot(now) {
+		if p.Alive && p.State == stateMaster.String() {
+			log.Println(p.Address, "took the services over while this node was down")
+			return true, false
+		}
+	}
+	if err := n.addrs.up(); err != nil {
+		log.Println(err)
+	}
+	return false, false
+}
+
+// sequences returns the sequence number of the last heartbeat sent and of the last one received from every peer and instance
+func (a *authenticator) sequences() (uint64, map[string]uint64) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	last := make(map[string]uint64, len(a.lastSeq))
+	for src, seq := range a.lastSeq {
+		last[src] = seq
+	}
+	return a.seq, last
+}
+
+// restoreSequences makes sure the sequence numbers keep growing across a restart, even when the clock went backwards,
+// and that heartbeats received before the restart can't be replayed
+func (a *authenticator) restoreSequences(seq uint64, last map[string]uint64) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if seq > a.seq {
+		a.seq = seq
+	}
+	for o, s := range last {
+		// state files of older versions are keyed by ip address only
+		src, instance, ok := strings.Cut(o, "/")
+		if _, err := strconv.Atoi(instance); !ok || err != nil || net.ParseIP(src) == nil {
+			continue
+		}
+		if s > a.lastSeq[o] {
+			a.lastSeq[o] = s
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Health probes of the services.
+// A probe is given as a comma separated list of key=value, e.g.
+// service=nginx,type=http,target=http://127.0.0.1/health,status=200,weight=50
+// service=postgresql,type=tcp,target=127.0.0.1:5432
+// service=nginx,type=systemctl
+// service=app,type=exec,target=/etc/scripts/check-app.sh,fall=5
+// A failing probe lowers the priority of this node by its weight. A probe without weight makes the node give up mastership when it fails.
+// Probes only run while this node runs the services, the last result is kept while it is passive so that a node that gave up does not take over again right away.
+// A unit that fails or crash-loops while this node runs the services, or fails to start, is handled like a failing probe without weight until it runs again.
+// The failed results kept by a passive node are forgotten after failureHoldDown, or right away with hactl reset, so that the node can fail back.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeArray holds the repeated probe flag
+type probeArray []string
+
+func (p *probeArray) String() string {
+	return strings.Join(*p, " ")
+}
+func (p *probeArray) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+const (
+	probeInterval = time.Second * 2
+	probeTimeout  = time.Second * 2
+	// failureHoldDown is how long a passive node keeps the failed results of its probes and units
+	failureHoldDown = time.Minute * 5
+)
+
+type probe struct {
+	service string
+	kind    string
+	target  string
+	status  int
+	weight  int
+	fall    int
+	rise    int
+
+	failures  int
+	successes int
+	failed    bool
+}
+
+type health struct {
+	m           sync.Mutex
+	probes      []*probe
+	failedUnits map[string]bool
+	active      bool
+	// passiveSince is when the node stopped the services, zero while they run or once the failed results were forgotten
+	passiveSince time.Time
+}
+
+func parseProbe(spec string) (*probe, error) {
+	p := &probe{status: http.StatusOK, fall: 3, rise: 1}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("Incorrect probe %s", spec)
+		}
+		var err error
+		switch k {
+		case "service":
+			p.service = v
+		case "type":
+			p.kind = v
+		case "target":
+			p.target = v
+		case "status":
+			p.status, err = strconv.Atoi(v)
+		case "weight":
+			p.weight, err = strconv.Atoi(v)
+		case "fall":
+			p.fall, err = strconv.Atoi(v)
+		case "rise":
+			p.rise, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("unknown key %s", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Incorrect probe %s: %v", spec, err)
+		}
+	}
+	if p.service == "" {
+		return nil, fmt.Errorf("Incorrect probe %s: service is missing", spec)
+	}
+	switch p.kind {
+	case "systemctl":
+		if p.target == "" {
+			p.target = p.service
+		}
+	case "tcp", "http", "exec":
+		if p.target == "" {
+			return nil, fmt.Errorf("Incorrect probe %s: target is missing", spec)
+		}
+	default:
+		return nil, fmt.Errorf("Incorrect probe %s: unknown type %s", spec, p.kind)
+	}
+	if p.weight < 0 || p.fall < 1 || p.rise < 1 {
+		return nil, fmt.Errorf("Incorrect probe %s: weight, fall and rise must be positive", spec)
+	}
+	return p, nil
+}
+
+func newHealth(specs []string, services []string) (*health, error) {
+	h := &health{failedUnits: make(map[string]bool)}
+	for _, s := range specs {
+		p, err := parseProbe(s)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, service := range services {
+			if service == p.service {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("probe for %s which is not a service to toggle", p.service)
+		}
+		h.probes = append(h.probes, p)
+	}
+	return h, nil
+}
+
+// run probes the services every probeInterval while the node is active and forgets the failed results once it has been passive
+// for failureHoldDown. It never returns.
+func (h *health) run() {
+	for {
+		h.m.Lock()
+		active := h.active
+		probes := h.probes
+		if !active && !h.passiveSince.IsZero() && time.Since(h.passiveSince) >= failureHoldDown {
+			h.passiveSince = time.Time{}
+			h.forget()
+		}
+		h.m.Unlock()
+		if active {
+			for _, p := range probes {
+				err := p.check()
+				h.m.Lock()
+				p.record(err)
+				h.m.Unlock()
+			}
+		}
+		time.Sleep(probeInterval)
+	}
+}
+
+// reset forgets the failed results of the probes and units, e.g. once the operator fixed them
+func (h *health) reset() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.forget()
+}
+
+func (h *health) forget() {
+	for _, p := range h.probes {
+		if p.failed {
+			log.Printf("forgetting the failed %s probe of %s", p.kind, p.service)
+		}
+		p.failed = false
+		p.failures, p.successes = 0, 0
+	}
+	for u := range h.failedUnits {
+		log.Printf("forgetting the failure of unit %s", u)
+		delete(h.failedUnits, u)
+	}
+}
+
+// watchUnits follows the state changes of the units. It never returns.
+func (h *health) watchUnits(c <-chan unitState) {
+	for s := range c {
+		h.m.Lock()
+		switch s.subState {
+		case "failed", "auto-restart":
+			if h.active && !h.failedUnits[s.name] {
+				log.Printf("unit %s is in %s state", s.name, s.subState)
+				h.failedUnits[s.name] = true
+			}
+		case "running", "exited":
+			if h.failedUnits[s.name] {
+				log.Printf("unit %s is %s again", s.name, s.subState)
+				delete(h.failedUnits, s.name)
+			}
+		}
+		h.m.Unlock()
+	}
+}
+
+// setProbes replaces the probes with the ones of other, e.g. after the configuration changed
+func (h *health) setProbes(other *health) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.probes = other.probes
+}
+
+// markFailed handles the unit like a failing probe without weight until it runs again, e.g. when it failed to start
+func (h *health) markFailed(unit string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.failedUnits[unit] = true
+}
+
+// setActive starts or pauses the probes. It is called when the node starts or stops the services.
+func (h *health) setActive(active bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if active && !h.active {
+		// give the services a full fall count to come up
+		for _, p := range h.probes {
+			p.failures = 0
+		}
+		h.passiveSince = time.Time{}
+	}
+	// also when the services failed to start
+	if !active && h.passiveSince.IsZero() {
+		h.passiveSince = time.Now()
+	}
+	h.active = active
+}
+
+// effective returns the priority to advertise and whether a unit or a probe without weight failed.
+func (h *health) effective(priority int) (int, bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	fault := len(h.failedUnits) > 0
+	for _, p := range h.probes {
+		if !p.failed {
+			continue
+		}
+		if p.weight == 0 {
+			fault = true
+		}
+		priority -= p.weight
+	}
+	if priority < 1 {
+		priority = 1
+	}
+	return priority, fault
+}
+
+func (p *probe) record(err error) {
+	if err != nil {
+		p.successes = 0
+		p.failures++
+		if !p.failed && p.failures >= p.fall {
+			log.Printf("%s probe of %s failed: %v", p.kind, p.service, err)
+			p.failed = true
+		}
+		return
+	}
+	p.failures = 0
+	p.successes++
+	if p.failed && p.successes >= p.rise {
+		log.Printf("%s probe of %s recovered", p.kind, p.service)
+		p.failed = false
+	}
+}
+
+func (p *probe) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	switch p.kind {
+	case "systemctl":
+		return exec.CommandContext(ctx, "systemctl", "is-active", "--quiet", p.target).Run()
+	case "exec":
+		return exec.CommandContext(ctx, p.target).Run()
+	case "tcp":
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", p.target)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != p.status {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Readiness, status and watchdog notifications to systemd, for units with Type=notify, see the sample unit in systemd_HA.go.
+// READY=1 is sent once the heartbeats are received and every instance decided its initial role, STATUS= tells the role of every
+// instance and how many peers are alive. With WatchdogSec= set in the unit, WATCHDOG=1 is sent every half of it as long as the
+// election of every instance keeps running its rounds. A round may take roundTimeout plus the timeout of each service it starts or stops
+// and of each fencing action, once it takes longer the pings stop and systemd restarts the daemon.
+// Nothing is sent when the daemon doesn't run under systemd.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// roundTimeout is how long a round of the election may take besides starting or stopping the services and fencing
+	roundTimeout   = time.Minute
+	statusInterval = time.Second * 5
+)
+
+// sdNotify sends state, e.g. READY=1, to systemd over $NOTIFY_SOCKET
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval of the watchdog pings asked for by systemd, 0 without watchdog
+func watchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	u, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || u <= 0 {
+		return 0, fmt.Errorf("Incorrect WATCHDOG_USEC %s", usec)
+	}
+	return time.Duration(u) * time.Microsecond / 2, nil
+}
+
+// notifySystemd tells systemd when the daemon is ready, its status on every transition and every statusInterval and pings the watchdog.
+// It must run once the heartbeats are received, it never returns.
+func (d *daemon) notifySystemd() {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	watchdog, err := watchdogInterval()
+	if err != nil {
+		log.Println(err)
+	}
+	changed := make(chan struct{}, 1)
+	for _, n := range d.list() {
+		n.fsm.onTransition(func(transition) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}
+	interval := statusInterval
+	if watchdog > 0 && watchdog < interval {
+		interval = watchdog
+	}
+	ticker := time.NewTicker(interval)
+	ready, stuck := false, false
+	for {
+		now := time.Now()
+		var state []string
+		if !ready && d.decided(now) {
+			state = append(state, "READY=1")
+			ready = true
+		}
+		state = append(state, "STATUS="+d.summary(now))
+		if watchdog > 0 {
+			if n := d.stuck(now); n != nil {
+				if !stuck {
+					log.Println("ALERT: the election of instance", n.instance, "is stuck, no more watchdog pings")
+				}
+				stuck = true
+			} else {
+				state = append(state, "WATCHDOG=1")
+				stuck = false
+			}
+		}
+		if err := sdNotify(strings.Join(state, "\n")); err != nil {
+			log.Println("unable to notify systemd:", err)
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// decided reports whether every instance left INIT or stays there on purpose, in maintenance or while it holds its role
+func (d *daemon) decided(now time.Time) bool {
+	for _, n := range d.list() {
+		if n.fsm.current() == stateInit && !n.inMaintenance() && !n.flaps.held(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// summary returns the role of every instance and how many of its peers are alive, e.g. MASTER, 1/2 peers alive
+func (d *daemon) summary(now time.Time) string {
+	var s []string
+	for _, n := range d.list() {
+		alive := 0
+		peers := n.members.snapshot(now)
+		for _, p := range peers {
+			if p.Alive {
+				alive++
+			}
+		}
+		line := fmt.Sprintf("%s, %d/%d peers alive", n.fsm.current(), alive, len(peers))
+		if n.inMaintenance() {
+			line += ", maintenance"
+		}
+		if len(d.ids) > 1 {
+			line = fmt.Sprintf("instance %d %s", n.instance, line)
+		}
+		s = append(s, line)
+	}
+	return strings.Join(s, "; ")
+}
+
+// stuck returns the first node whose election didn't run its round in time, nil when every election runs
+func (d *daemon) stuck(now time.Time) *node {
+	for _, n := range d.list() {
+		n.m.Lock()
+		due := n.due
+		n.m.Unlock()
+		if !due.IsZero() && now.After(due) {
+			return n
+		}
+	}
+	return nil
+}
+
+// expect records that the election of the node runs and is heard from again within d plus roundTimeout
+func (n *node) expect(d time.Duration) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.due = time.Now().Add(d + roundTimeout)
+}
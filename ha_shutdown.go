@@ -0,0 +1,90 @@
+// Shutdown on SIGTERM or SIGINT, e.g. systemctl stop.
+// With shutdown: stop (the default) a master stops its services in reverse order and removes its virtual ip addresses, still
+// advertising its priority so that no peer starts them meanwhile, then resigns: it sends heartbeats with priority 0 that make the
+// peers treat it as gone at once, without waiting for the dead interval or fencing it. A backup only resigns.
+// With shutdown: keep, or in maintenance, the services keep running and nothing is sent, the peers only notice once the dead interval
+// passed. This is meant for restarts of the daemon, which then resumes its role, see ha_persist.go.
+// A second signal exits right away.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// resignCount is the number of resigning heartbeats sent, in case some are lost
+const resignCount = 3
+
+func checkShutdown(mode string) error {
+	if mode != "stop" && mode != "keep" {
+		return fmt.Errorf("Incorrect shutdown %s, use stop or keep", mode)
+	}
+	return nil
+}
+
+// watchShutdown shuts every instance down on SIGTERM or SIGINT and exits, send sends a heartbeat of a node to its peers.
+// It never returns.
+func (d *daemon) watchShutdown(send func(n *node, p packet)) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	s := <-c
+	log.Println(s, "received, shutting down")
+	if err := sdNotify("STOPPING=1\nSTATUS=shutting down"); err != nil {
+		log.Println("unable to notify systemd:", err)
+	}
+	go func() {
+		s := <-c
+		log.Println(s, "received again, exiting right away")
+		os.Exit(1)
+	}()
+	var wg sync.WaitGroup
+	for _, n := range d.list() {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			n.shutdown(send)
+		}(n)
+	}
+	wg.Wait()
+	if d.stateFile != "" {
+		if err := d.save(d.stateFile); err != nil {
+			log.Println("unable to save the state:", err)
+		}
+	}
+	log.Println("stopped")
+	os.Exit(0)
+}
+
+// shutdown ends the election of the node, stops its services unless they are kept and resigns
+func (n *node) shutdown(send func(n *node, p packet)) {
+	// wait for the current round, the next ones return right away
+	n.round.Lock()
+	n.stopping = true
+	n.round.Unlock()
+	n.m.Lock()
+	keep := n.onShutdown == "keep" || n.maintenance
+	n.m.Unlock()
+	if keep {
+		log.Println("leaving the services as they are")
+		return
+	}
+	if n.fsm.current() == stateMaster {
+		if err := n.fsm.transition(stateBackup, "shutting down"); err != nil {
+			log.Println(err)
+		}
+		if err := n.toggle(false); err != nil {
+			log.Println("ALERT:", err)
+		}
+	}
+	n.m.Lock()
+	n.resigned = true
+	n.m.Unlock()
+	for i := 0; i < resignCount; i++ {
+		send(n, n.nextPacket())
+	}
+}
@@ -0,0 +1,126 @@
+// State machine of a node.
+// INIT    waiting for the peers to show up, nothing is started or stopped
+// BACKUP  another node runs the services
+// MASTER  this node runs the services
+// FAULT   nobody can safely run the services from this node's point of view (e.g. a peer runs a different configuration)
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type haState int
+
+const (
+	stateInit haState = iota
+	stateBackup
+	stateMaster
+	stateFault
+)
+
+func (s haState) String() string {
+	switch s {
+	case stateInit:
+		return "INIT"
+	case stateBackup:
+		return "BACKUP"
+	case stateMaster:
+		return "MASTER"
+	case stateFault:
+		return "FAULT"
+	}
+	return fmt.Sprintf("haState(%d)", int(s))
+}
+
+// transitions lists the allowed transitions. INIT and FAULT have to go through BACKUP to become MASTER.
+var transitions = map[haState][]haState{
+	stateInit:   {stateBackup, stateFault},
+	stateBackup: {stateMaster, stateFault},
+	stateMaster: {stateBackup, stateFault},
+	stateFault:  {stateBackup},
+}
+
+// transition is emitted on every change of state
+type transition struct {
+	From   haState
+	To     haState
+	Reason string
+	At     time.Time
+}
+
+type stateMachine struct {
+	m        sync.Mutex
+	state    haState
+	since    time.Time
+	handlers []func(transition)
+	// name is logged with the transitions, it tells the instances of a daemon apart
+	name string
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{state: stateInit, since: time.Now()}
+}
+
+func (s *stateMachine) current() haState {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.state
+}
+
+// status returns the current state and when it was entered
+func (s *stateMachine) status() (haState, time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.state, s.since
+}
+
+// restore puts the state machine back in the state it was in before a restart, without calling the handlers
+func (s *stateMachine) restore(state haState, since time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	log.Printf("resuming the %s state held since %s", state, since.Format(time.RFC3339))
+	s.state = state
+	s.since = since
+}
+
+// onTransition registers f to be called after every transition. Handlers run in the election loop and must not block.
+func (s *stateMachine) onTransition(f func(transition)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.handlers = append(s.handlers, f)
+}
+
+// transition moves the state machine to the state to, an error is returned when the transition is not allowed.
+func (s *stateMachine) transition(to haState, reason string) error {
+	s.m.Lock()
+	allowed := false
+	for _, next := range transitions[s.state] {
+		if next == to {
+			allowed = true
+		}
+	}
+	if !allowed {
+		from := s.state
+		s.m.Unlock()
+		return fmt.Errorf("transition from %s to %s is not allowed", from, to)
+	}
+	t := transition{From: s.state, To: to, Reason: reason, At: time.Now()}
+	s.state = to
+	s.since = t.At
+	handlers := s.handlers
+	s.m.Unlock()
+
+	if s.name != "" {
+		log.Printf("%s: %s -> %s: %s", s.name, t.From, t.To, t.Reason)
+	} else {
+		log.Printf("%s -> %s: %s", t.From, t.To, t.Reason)
+	}
+	for _, f := range handlers {
+		f(t)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestTransitions(t *testing.T) {
+	states := []haState{stateInit, stateBackup, stateMaster, stateFault}
+	allowed := map[[2]haState]bool{
+		{stateInit, stateBackup}:   true,
+		{stateInit, stateFault}:    true,
+		{stateBackup, stateMaster}: true,
+		{stateBackup, stateFault}:  true,
+		{stateMaster, stateBackup}: true,
+		{stateMaster, stateFault}:  true,
+		{stateFault, stateBackup}:  true,
+	}
+	for _, from := range states {
+		for _, to := range states {
+			t.Run(from.String()+"->"+to.String(), func(t *testing.T) {
+				s := newStateMachine()
+				s.state = from
+				var got []transition
+				s.onTransition(func(tr transition) { got = append(got, tr) })
+				err := s.transition(to, "test")
+				if !allowed[[2]haState{from, to}] {
+					if err == nil {
+						t.Fatalf("transition from %s to %s allowed", from, to)
+					}
+					if s.current() != from || len(got) != 0 {
+						t.Errorf("refused transition moved to %s and called %d handlers", s.current(), len(got))
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s.current() != to {
+					t.Errorf("state is %s, want %s", s.current(), to)
+				}
+				if len(got) != 1 || got[0].From != from || got[0].To != to || got[0].Reason != "test" {
+					t.Errorf("handlers called with %+v", got)
+				}
+			})
+		}
+	}
+}
+
+func TestStateString(t *testing.T) {
+	for s, want := range map[haState]string{stateInit: "INIT", stateBackup: "BACKUP", stateMaster: "MASTER", stateFault: "FAULT", 7: "haState(7)"} {
+		if s.String() != want {
+			t.Errorf("%d is %s, want %s", int(s), s.String(), want)
+		}
+	}
+}
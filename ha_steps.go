@@ -0,0 +1,99 @@
+// Ordered start and stop of the services.
+// Every service flag (-SERVICE in v1, -s in v2) is a step. The steps start in the given order, each one once the previous one is up,
+// and stop in reverse order. A step may hold several units started together, separated by +, and its own timeout after /, e.g.
+// -SERVICE data.mount/30s -SERVICE postgresql/5m -SERVICE app+worker
+// The timeout defaults to unitJobTimeout. When a step fails to start, the steps already started are stopped in reverse order.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type step struct {
+	units   []string
+	timeout time.Duration
+}
+
+// parseSteps returns the steps and every unit of the steps in order
+func parseSteps(specs []string) ([]step, []string, error) {
+	var steps []step
+	var units []string
+	for _, spec := range specs {
+		s := step{timeout: unitJobTimeout}
+		names, timeout, ok := strings.Cut(spec, "/")
+		if ok {
+			var err error
+			if s.timeout, err = time.ParseDuration(timeout); err != nil || s.timeout <= 0 {
+				return nil, nil, fmt.Errorf("Incorrect timeout of service %s", spec)
+			}
+		}
+		for _, name := range strings.Split(names, "+") {
+			if name == "" {
+				return nil, nil, fmt.Errorf("Incorrect service %s", spec)
+			}
+			s.units = append(s.units, name)
+		}
+		steps = append(steps, s)
+		units = append(units, s.units...)
+	}
+	return steps, units, nil
+}
+
+// startSteps starts the steps in order. When a step fails, its units are marked failed and every step started so far is stopped again.
+func (n *node) startSteps(steps []step) error {
+	for i, s := range steps {
+		if err := n.runStep(s, "start"); err != nil {
+			log.Println("ALERT:", err, "stopping the services started so far")
+			n.stopSteps(steps[:i+1])
+			return err
+		}
+	}
+	return nil
+}
+
+// stopSteps stops the steps in reverse order, a failed step doesn't prevent the next ones from stopping
+func (n *node) stopSteps(steps []step) error {
+	var errs []error
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := n.runStep(steps[i], "stop"); err != nil {
+			log.Println(err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runStep starts or stops the units of a step together and waits for all of them
+func (n *node) runStep(s step, action string) error {
+	f := n.units.start
+	if action == "stop" {
+		f = n.units.stop
+	}
+	n.expect(s.timeout)
+	errs := make([]error, len(s.units))
+	var wg sync.WaitGroup
+	for i, u := range s.units {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = f(u, s.timeout); errs[i] != nil {
+				n.stats.unitError(u, action)
+				if action == "start" {
+					n.health.markFailed(u)
+				}
+				return
+			}
+			if action == "start" {
+				log.Println("started", u)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
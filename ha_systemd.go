@@ -0,0 +1,179 @@
+// Systemd backends used to toggle the services.
+// The default backend talks to org.freedesktop.systemd1 over the system bus (github.com/coreos/go-systemd/v22/dbus), waits for every job to finish
+// and reports state changes of the units as they happen. The systemctl backend is used when the system bus is not reachable.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+)
+
+// unitJobTimeout is the default bound of the wait for a start or stop job, it matches the default TimeoutStartSec of systemd
+const unitJobTimeout = time.Second * 90
+
+type unitState struct {
+	name     string
+	subState string
+}
+
+// unitManager starts and stops systemd units. start and stop return once the job has finished or the timeout passed.
+type unitManager interface {
+	start(name string, timeout time.Duration) error
+	stop(name string, timeout time.Duration) error
+	isActive(name string) (bool, error)
+	// watch reports the sub state of the units every time it changes
+	watch(names []string) (<-chan unitState, error)
+}
+
+// newUnitManager connects to systemd over dbus and falls back to systemctl.
+func newUnitManager() unitManager {
+	u, err := newDbusUnits()
+	if err != nil {
+		log.Println("unable to connect to systemd over dbus, falling back to systemctl:", err)
+		return &systemctlUnits{}
+	}
+	return u
+}
+
+type dbusUnits struct {
+	conn *dbus.Conn
+}
+
+func newDbusUnits() (*dbusUnits, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	conn, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &dbusUnits{conn: conn}, nil
+}
+
+func (u *dbusUnits) start(name string, timeout time.Duration) error {
+	return u.job("start", name, timeout, u.conn.StartUnitContext)
+}
+
+func (u *dbusUnits) stop(name string, timeout time.Duration) error {
+	return u.job("stop", name, timeout, u.conn.StopUnitContext)
+}
+
+func (u *dbusUnits) job(action, name string, timeout time.Duration, f func(context.Context, string, string, chan<- string) (int, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ch := make(chan string, 1)
+	if _, err := f(ctx, name, "replace", ch); err != nil {
+		return fmt.Errorf("%s %s: %v", action, name, err)
+	}
+	select {
+	case result := <-ch:
+		if result != "done" {
+			return fmt.Errorf("%s %s: job %s", action, name, result)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s %s: %v", action, name, ctx.Err())
+	}
+}
+
+func (u *dbusUnits) isActive(name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	units, err := u.conn.ListUnitsByNamesContext(ctx, []string{name})
+	if err != nil {
+		return false, err
+	}
+	if len(units) == 0 {
+		return false, fmt.Errorf("unit %s not found", name)
+	}
+	return units[0].ActiveState == "active", nil
+}
+
+func (u *dbusUnits) watch(names []string) (<-chan unitState, error) {
+	if err := u.conn.Subscribe(); err != nil {
+		return nil, err
+	}
+	updates := make(chan *dbus.SubStateUpdate, 16)
+	errs := make(chan error, 16)
+	u.conn.SetSubStateSubscriber(updates, errs)
+	c := make(chan unitState, 16)
+	go func() {
+		for {
+			select {
+			case update := <-updates:
+				for _, n := range names {
+					if unitName(n) == update.UnitName {
+						c <- unitState{name: n, subState: update.SubState}
+					}
+				}
+			case err := <-errs:
+				log.Println("systemd dbus subscription:", err)
+			}
+		}
+	}()
+	return c, nil
+}
+
+// unitName adds the .service suffix systemctl assumes when a unit is given without type
+func unitName(name string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return name + ".service"
+}
+
+type systemctlUnits struct{}
+
+func (u *systemctlUnits) start(name string, timeout time.Duration) error {
+	return u.job("start", name, timeout)
+}
+
+func (u *systemctlUnits) stop(name string, timeout time.Duration) error {
+	return u.job("stop", name, timeout)
+}
+
+func (u *systemctlUnits) job(action, name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, "systemctl", action, name).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", action, name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (u *systemctlUnits) isActive(name string) (bool, error) {
+	err := exec.Command("systemctl", "is-active", "--quiet", name).Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// watch polls the sub state of the units as systemctl has no way to subscribe to changes
+func (u *systemctlUnits) watch(names []string) (<-chan unitState, error) {
+	c := make(chan unitState, 16)
+	go func() {
+		last := make(map[string]string)
+		for {
+			for _, n := range names {
+				out, err := exec.Command("systemctl", "show", "--property=SubState", "--value", n).Output()
+				if err != nil {
+					continue
+				}
+				subState := strings.TrimSpace(string(out))
+				if subState != last[n] {
+					last[n] = subState
+					c <- unitState{name: n, subState: subState}
+				}
+			}
+			time.Sleep(time.Second * 2)
+		}
+	}()
+	return c, nil
+}
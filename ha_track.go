@@ -0,0 +1,301 @@
+// Tracked interfaces and scripts. Unlike the health probes they run on every node, active or not, so that a node with a broken uplink
+// neither keeps nor takes over the services. A tracked item is given as a comma separated list of key=value, e.g.
+// type=interface,target=eth1,weight=50                 the link of eth1 must be up and running, followed over rtnetlink
+// type=script,target=/etc/scripts/check-gw.sh,weight=20 the script must exit with 0, run every 2s, fall and rise as for probes
+// A failed item lowers the advertised priority by its weight, the master hands the services over once a backup advertises more.
+// An item without weight makes the node give up mastership when it fails, also in nopreempt mode.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// trackArray holds the repeated track flag
+type trackArray []string
+
+func (t *trackArray) String() string {
+	return strings.Join(*t, " ")
+}
+func (t *trackArray) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+const (
+	trackInterval = time.Second * 2
+	// rtmgrpLink is the multicast group of the link changes, RTMGRP_LINK in linux/rtnetlink.h
+	rtmgrpLink = 0x1
+)
+
+type tracked struct {
+	kind   string
+	target string
+	weight int
+	fall   int
+	rise   int
+
+	failures  int
+	successes int
+	failed    bool
+}
+
+type tracker struct {
+	m     sync.Mutex
+	items []*tracked
+}
+
+func parseTrack(spec string) (*tracked, error) {
+	t := &tracked{fall: 3, rise: 1}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("Incorrect track %s", spec)
+		}
+		var err error
+		switch k {
+		case "type":
+			t.kind = v
+		case "target":
+			t.target = v
+		case "weight":
+			t.weight, err = strconv.Atoi(v)
+		case "fall":
+			t.fall, err = strconv.Atoi(v)
+		case "rise":
+			t.rise, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("unknown key %s", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Incorrect track %s: %v", spec, err)
+		}
+	}
+	switch t.kind {
+	case "interface", "script":
+		if t.target == "" {
+			return nil, fmt.Errorf("Incorrect track %s: target is missing", spec)
+		}
+	default:
+		return nil, fmt.Errorf("Incorrect track %s: unknown type %s", spec, t.kind)
+	}
+	if t.weight < 0 || t.fall < 1 || t.rise < 1 {
+		return nil, fmt.Errorf("Incorrect track %s: weight, fall and rise must be positive", spec)
+	}
+	return t, nil
+}
+
+func newTracker(specs []string) (*tracker, error) {
+	tr := &tracker{}
+	for _, s := range specs {
+		t, err := parseTrack(s)
+		if err != nil {
+			return nil, err
+		}
+		tr.items = append(tr.items, t)
+	}
+	return tr, nil
+}
+
+// run follows the links over rtnetlink and runs the scripts every trackInterval. It never returns.
+// The links are read again on every round as well, in case a netlink message was lost.
+func (tr *tracker) run() {
+	if err := watchLinks(tr.link); err != nil {
+		log.Println("unable to follow the links over netlink, polling them:", err)
+	}
+	for {
+		tr.m.Lock()
+		items := tr.items
+		tr.m.Unlock()
+		for _, t := range items {
+			var err error
+			switch t.kind {
+			case "interface":
+				err = linkState(t.target)
+			case "script":
+				err = t.runScript()
+			}
+			tr.m.Lock()
+			t.record(err)
+			tr.m.Unlock()
+		}
+		time.Sleep(trackInterval)
+	}
+}
+
+// link records a change of the link name reported over netlink, err is nil when it is up
+func (tr *tracker) link(name string, err error) {
+	tr.m.Lock()
+	defer tr.m.Unlock()
+	for _, t := range tr.items {
+		if t.kind == "interface" && t.target == name {
+			t.setLink(err)
+		}
+	}
+}
+
+// set replaces the tracked items with the ones of other, e.g. after the configuration changed
+func (tr *tracker) set(other *tracker) {
+	tr.m.Lock()
+	defer tr.m.Unlock()
+	tr.items = other.items
+}
+
+// effective returns the priority lowered by the weight of the failed items and whether an item without weight failed
+func (tr *tracker) effective(priority int) (int, bool) {
+	tr.m.Lock()
+	defer tr.m.Unlock()
+	fault := false
+	for _, t := range tr.items {
+		if !t.failed {
+			continue
+		}
+		if t.weight == 0 {
+			fault = true
+		}
+		priority -= t.weight
+	}
+	return priority, fault
+}
+
+// trackStatus is the state of a tracked item as reported by the control socket
+type trackStatus struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	Weight int    `json:"weight"`
+	Failed bool   `json:"failed"`
+}
+
+func (tr *tracker) status() []trackStatus {
+	tr.m.Lock()
+	defer tr.m.Unlock()
+	var s []trackStatus
+	for _, t := range tr.items {
+		s = append(s, trackStatus{Type: t.kind, Target: t.target, Weight: t.weight, Failed: t.failed})
+	}
+	return s
+}
+
+// setLink records the state of a link, a link going down or up is not debounced
+func (t *tracked) setLink(err error) {
+	if err != nil && !t.failed {
+		log.Printf("tracked interface %s is down: %v", t.target, err)
+		t.failed = true
+	} else if err == nil && t.failed {
+		log.Printf("tracked interface %s is up", t.target)
+		t.failed = false
+	}
+	t.failures, t.successes = 0, 0
+}
+
+func (t *tracked) record(err error) {
+	if t.kind == "interface" {
+		t.setLink(err)
+		return
+	}
+	if err != nil {
+		t.successes = 0
+		t.failures++
+		if !t.failed && t.failures >= t.fall {
+			log.Printf("tracked script %s failed: %v", t.target, err)
+			t.failed = true
+		}
+		return
+	}
+	t.failures = 0
+	t.successes++
+	if t.failed && t.successes >= t.rise {
+		log.Printf("tracked script %s recovered", t.target)
+		t.failed = false
+	}
+}
+
+func (t *tracked) runScript() error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, t.target).Run()
+}
+
+// linkState returns nil when the link name is up and running
+func linkState(name string) error {
+	ief, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if ief.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("administratively down")
+	}
+	if ief.Flags&net.FlagRunning == 0 {
+		return fmt.Errorf("no carrier")
+	}
+	return nil
+}
+
+// watchLinks calls f with the name and state of every link that changes, as reported by the kernel over rtnetlink.
+// It returns once it is subscribed.
+func watchLinks(f func(name string, err error)) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink}); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	go func() {
+		defer syscall.Close(fd)
+		b := make([]byte, 1<<16)
+		for {
+			n, _, err := syscall.Recvfrom(fd, b, 0)
+			if err == syscall.EINTR || err == syscall.ENOBUFS {
+				// messages were lost, the next round reads every link again
+				continue
+			}
+			if err != nil {
+				log.Println("netlink:", err)
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(b[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				if m.Header.Type != syscall.RTM_NEWLINK && m.Header.Type != syscall.RTM_DELLINK || len(m.Data) < syscall.SizeofIfInfomsg {
+					continue
+				}
+				attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+				if err != nil {
+					continue
+				}
+				name := ""
+				for _, a := range attrs {
+					if a.Attr.Type == syscall.IFLA_IFNAME {
+						name = strings.TrimRight(string(a.Value), "\x00")
+					}
+				}
+				flags := binary.NativeEndian.Uint32(m.Data[8:])
+				switch {
+				case m.Header.Type == syscall.RTM_DELLINK:
+					f(name, fmt.Errorf("removed"))
+				case flags&syscall.IFF_UP == 0:
+					f(name, fmt.Errorf("administratively down"))
+				case flags&syscall.IFF_RUNNING == 0:
+					f(name, fmt.Errorf("no carrier"))
+				default:
+					f(name, nil)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,225 @@
+// Virtual ip addresses that follow the master.
+// Addresses are added and removed over rtnetlink and announced with gratuitous arp (ipv4) or unsolicited neighbor advertisements (ipv6)
+// so that switches and neighbors update their tables right away.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// vipArray holds the repeated virtual ip flag, e.g. -VIP 10.77.0.10/24
+type vipArray []string
+
+func (v *vipArray) String() string {
+	return strings.Join(*v, ",")
+}
+func (v *vipArray) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+type vip struct {
+	ief   *net.Interface
+	addrs []*net.IPNet
+}
+
+// garpCount is the number of announcements sent for every address when it is brought up
+const garpCount = 3
+
+func newVIP(ief *net.Interface, cidrs []string) (*vip, error) {
+	v := &vip{ief: ief}
+	for _, c := range cidrs {
+		ip, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("Incorrect virtual ip address %s", c)
+		}
+		ipnet.IP = ip
+		v.addrs = append(v.addrs, ipnet)
+	}
+	if len(v.addrs) > 0 && ief == nil {
+		return nil, fmt.Errorf("a network interface is required for virtual ip addresses")
+	}
+	return v, nil
+}
+
+// up adds every virtual ip address to the interface and announces it.
+func (v *vip) up() error {
+	if v == nil {
+		return nil
+	}
+	for _, a := range v.addrs {
+		err := addrRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, v.ief, a)
+		if err == nil {
+			log.Println("virtual ip", a, "added to", v.ief.Name)
+		} else if err != syscall.EEXIST {
+			return fmt.Errorf("unable to add %s to %s: %v", a, v.ief.Name, err)
+		}
+		for n := 0; n < garpCount; n++ {
+			if a.IP.To4() != nil {
+				err = sendGratuitousARP(v.ief, a.IP)
+			} else {
+				err = sendUnsolicitedNA(v.ief, a.IP)
+			}
+			if err != nil {
+				log.Println("unable to announce", a.IP, err)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// down removes every virtual ip address from the interface.
+func (v *vip) down() error {
+	if v == nil {
+		return nil
+	}
+	for _, a := range v.addrs {
+		err := addrRequest(syscall.RTM_DELADDR, 0, v.ief, a)
+		if err == syscall.EADDRNOTAVAIL {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to remove %s from %s: %v", a, v.ief.Name, err)
+		}
+		log.Println("virtual ip", a, "removed from", v.ief.Name)
+	}
+	return nil
+}
+
+// addrRequest sends a RTM_NEWADDR or RTM_DELADDR request for a to the kernel and waits for the acknowledgement.
+func addrRequest(msgType, flags uint16, ief *net.Interface, a *net.IPNet) error {
+	family := syscall.AF_INET
+	ip := a.IP.To4()
+	ifaFlags := 0
+	if ip == nil {
+		family = syscall.AF_INET6
+		ip = a.IP.To16()
+		// the address is moved between nodes so duplicate address detection would only delay it
+		ifaFlags = syscall.IFA_F_NODAD
+	}
+	ones, _ := a.Mask.Size()
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	b := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofIfAddrmsg)
+	b[syscall.NLMSG_HDRLEN] = byte(family)
+	b[syscall.NLMSG_HDRLEN+1] = byte(ones)
+	b[syscall.NLMSG_HDRLEN+2] = byte(ifaFlags)
+	binary.NativeEndian.PutUint32(b[syscall.NLMSG_HDRLEN+4:], uint32(ief.Index))
+	b = appendRtAttr(b, syscall.IFA_LOCAL, ip)
+	b = appendRtAttr(b, syscall.IFA_ADDRESS, ip)
+	binary.NativeEndian.PutUint32(b[0:], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:], msgType)
+	binary.NativeEndian.PutUint16(b[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(b[8:], 1)
+
+	if err := syscall.Sendto(fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	rb := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, rb, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+func appendRtAttr(b []byte, attrType uint16, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	a := make([]byte, (l+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(a[0:], uint16(l))
+	binary.NativeEndian.PutUint16(a[2:], attrType)
+	copy(a[syscall.SizeofRtAttr:], data)
+	return append(b, a...)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// sendGratuitousARP broadcasts an arp request for ip from the mac address of the interface.
+func sendGratuitousARP(ief *net.Interface, ip net.IP) error {
+	if len(ief.HardwareAddr) != 6 {
+		return fmt.Errorf("interface %s has no ethernet address", ief.Name)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	p := make([]byte, 28)
+	binary.BigEndian.PutUint16(p[0:], 1) // ethernet
+	binary.BigEndian.PutUint16(p[2:], syscall.ETH_P_IP)
+	p[4] = 6
+	p[5] = 4
+	binary.BigEndian.PutUint16(p[6:], 1) // request
+	copy(p[8:], ief.HardwareAddr)
+	copy(p[14:], ip.To4())
+	copy(p[24:], ip.To4())
+
+	sa := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  ief.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	return syscall.Sendto(fd, p, 0, sa)
+}
+
+// sendUnsolicitedNA sends a neighbor advertisement for ip with the override flag set to all nodes on the link.
+func sendUnsolicitedNA(ief *net.Interface, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ief.Index); err != nil {
+		return err
+	}
+
+	// the kernel fills in the icmpv6 checksum on raw sockets
+	p := make([]byte, 24, 32)
+	p[0] = 136 // neighbor advertisement
+	p[4] = 0x20
+	copy(p[8:], ip.To16())
+	if len(ief.HardwareAddr) == 6 {
+		p = append(p, 2, 1) // target link-layer address
+		p = append(p, ief.HardwareAddr...)
+	}
+
+	sa := &syscall.SockaddrInet6{ZoneId: uint32(ief.Index)}
+	copy(sa.Addr[:], net.IPv6linklocalallnodes)
+	return syscall.Sendto(fd, p, 0, sa)
+}
@@ -0,0 +1,281 @@
+// Wire format of the heartbeats, shared by systemd_HA.go and systemd_HA_v2.go. All integers are big endian.
+//
+//	header   magic "SDHA" (4) | version (1) | flags (1) | key id length (1) | key id
+//	body     instance (4) | node id length (1) | node id | sequence (8) | unix time in ns (8) | role (1) | priority (2) |
+//	         sha256 of the sorted services (32) | handover length (1) | handover ip address
+//	trailer  HMAC-SHA256 of header and body with the mac key (32), only when flagAuthenticated is set
+//
+// When flagEncrypted is set the body is replaced by a 12 byte nonce followed by the body sealed with AES-256-GCM
+// using the encryption key, the header being the additional data. Both flags require a key id, see ha_keys.go.
+// The role is the haState of the sender. A receiver drops packets of an unknown version.
+// flagMaintenance is set while the sender is in maintenance, see ha_maintenance.go. flagFault is set while the sender is unhealthy or
+// demoted, any healthy peer then takes the services over whatever its priority.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	wireMagic   = "SDHA"
+	wireVersion = 1
+
+	flagAuthenticated = 1 << 0
+	flagEncrypted     = 1 << 1
+	flagMaintenance   = 1 << 2
+	flagFault         = 1 << 3
+
+	macSize = sha256.Size
+)
+
+// packet is the content of a heartbeat
+type packet struct {
+	instance    int
+	node        string
+	seq         uint64
+	time        int64
+	role        haState
+	priority    int
+	services    [sha256.Size]byte
+	handover    string
+	maintenance bool
+	fault       bool
+}
+
+// packetError is returned by decodePacket, reason is the label of the heartbeat error metric
+type packetError struct {
+	reason string
+	err    error
+}
+
+func (e *packetError) Error() string {
+	return e.err.Error()
+}
+
+func dropPacket(reason, format string, a ...interface{}) *packetError {
+	return &packetError{reason: reason, err: fmt.Errorf(format, a...)}
+}
+
+// serviceSetHash identifies a set of services regardless of their order
+func serviceSetHash(services []string) [sha256.Size]byte {
+	sorted := append([]string{}, services...)
+	sort.Strings(sorted)
+	var b []byte
+	for _, s := range sorted {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+		b = append(b, s...)
+	}
+	return sha256.Sum256(b)
+}
+
+// encodePacket signs the packet with the current key of a, and encrypts it when encrypt is set. a may be nil.
+func encodePacket(p packet, a *authenticator, encrypt bool) ([]byte, error) {
+	if len(p.node) > 255 || len(p.handover) > 255 {
+		return nil, fmt.Errorf("node id or handover address too long")
+	}
+	if p.priority < 0 || p.priority > 0xffff {
+		return nil, fmt.Errorf("priority %d out of range", p.priority)
+	}
+	var k *key
+	var flags byte
+	if a != nil {
+		k = a.signingKey()
+		if len(k.id) > 255 {
+			return nil, fmt.Errorf("key id %s too long", k.id)
+		}
+		flags |= flagAuthenticated
+		if encrypt {
+			flags |= flagEncrypted
+		}
+	}
+	if p.maintenance {
+		flags |= flagMaintenance
+	}
+	if p.fault {
+		flags |= flagFault
+	}
+	b := append([]byte(wireMagic), wireVersion, flags)
+	if k != nil {
+		b = append(b, byte(len(k.id)))
+		b = append(b, k.id...)
+	} else {
+		b = append(b, 0)
+	}
+	header := len(b)
+
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, uint32(p.instance))
+	body = append(body, byte(len(p.node)))
+	body = append(body, p.node...)
+	body = binary.BigEndian.AppendUint64(body, p.seq)
+	body = binary.BigEndian.AppendUint64(body, uint64(p.time))
+	body = append(body, byte(p.role))
+	body = binary.BigEndian.AppendUint16(body, uint16(p.priority))
+	body = append(body, p.services[:]...)
+	body = append(body, byte(len(p.handover)))
+	body = append(body, p.handover...)
+
+	if flags&flagEncrypted != 0 {
+		gcm, err := newGCM(k)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		b = append(b, nonce...)
+		b = gcm.Seal(b, nonce, body, b[:header])
+	} else {
+		b = append(b, body...)
+	}
+	if k != nil {
+		b = append(b, a.sign(k, b)...)
+	}
+	return b, nil
+}
+
+// decodePacket parses a heartbeat received from src. When a isn't nil the packet must be signed with one of its keys,
+// fresh and not replayed. Errors are *packetError.
+func decodePacket(b []byte, a *authenticator, src string) (packet, error) {
+	var p packet
+	r := &reader{b: b}
+	if !bytes.Equal(r.next(len(wireMagic)), []byte(wireMagic)) {
+		return p, dropPacket("format", "not a heartbeat")
+	}
+	if v := r.byte(); v != wireVersion {
+		return p, dropPacket("format", "unsupported protocol version %d", v)
+	}
+	flags := r.byte()
+	keyID := string(r.next(int(r.byte())))
+	if r.err != nil {
+		return p, dropPacket("format", "truncated header")
+	}
+	header := r.off
+
+	var k *key
+	if a != nil {
+		if flags&flagAuthenticated == 0 {
+			return p, dropPacket("auth", "heartbeat isn't authenticated")
+		}
+		var err error
+		if k, err = a.lookup(keyID); err != nil {
+			return p, dropPacket("key", "%v", err)
+		}
+		if len(b) < header+macSize {
+			return p, dropPacket("format", "truncated heartbeat")
+		}
+		signed, mac := b[:len(b)-macSize], b[len(b)-macSize:]
+		if !hmac.Equal(a.sign(k, signed), mac) {
+			return p, dropPacket("checksum", "invalid mac")
+		}
+		r.b = signed
+	} else if flags&(flagAuthenticated|flagEncrypted) != 0 {
+		return p, dropPacket("auth", "heartbeat is authenticated but no key is configured")
+	}
+
+	if flags&flagEncrypted != 0 {
+		gcm, err := newGCM(k)
+		if err != nil {
+			return p, dropPacket("decrypt", "%v", err)
+		}
+		nonce := r.next(gcm.NonceSize())
+		if r.err != nil {
+			return p, dropPacket("format", "truncated heartbeat")
+		}
+		body, err := gcm.Open(nil, nonce, r.b[r.off:], r.b[:header])
+		if err != nil {
+			return p, dropPacket("decrypt", "%v", err)
+		}
+		r = &reader{b: body}
+	}
+
+	p.instance = int(r.uint32())
+	p.node = string(r.next(int(r.byte())))
+	p.seq = r.uint64()
+	p.time = int64(r.uint64())
+	p.role = haState(r.byte())
+	p.priority = int(r.uint16())
+	copy(p.services[:], r.next(len(p.services)))
+	p.handover = string(r.next(int(r.byte())))
+	p.maintenance = flags&flagMaintenance != 0
+	p.fault = flags&flagFault != 0
+	if r.err != nil {
+		return p, dropPacket("format", "truncated heartbeat")
+	}
+	if r.off != len(r.b) {
+		return p, dropPacket("format", "%d trailing bytes", len(r.b)-r.off)
+	}
+	if p.role < stateInit || p.role > stateFault {
+		return p, dropPacket("format", "unknown role %d", p.role)
+	}
+	if a != nil {
+		if err := a.fresh(src, p.instance, p.seq, p.time); err != nil {
+			return p, dropPacket("replay", "%v", err)
+		}
+	}
+	return p, nil
+}
+
+func newGCM(k *key) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(k.enc)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+// reader reads the fields of a packet, err is set once a field goes past the end
+type reader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil || n > len(r.b)-r.off {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+// Tests of the wire format, run with the other ha files, e.g.
+// go test ha_*.go
+// go test -fuzz FuzzDecodePacket ha_*.go
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func testAuthenticator(t testing.TB) *authenticator {
+	keys, err := newKeyring("correct-horse-battery-staple", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newAuthenticator(keys)
+}
+
+func testPacket(a *authenticator) packet {
+	p := packet{
+		instance: 10,
+		node:     "node-a",
+		role:     stateMaster,
+		priority: 100,
+		services: serviceSetHash([]string{"nginx", "postgresql"}),
+		handover: "10.77.0.3",
+	}
+	if a != nil {
+		p.seq, p.time = a.next()
+	}
+	return p
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		auth        bool
+		encrypt     bool
+		maintenance bool
+		fault       bool
+	}{
+		{name: "plain"},
+		{name: "plain maintenance", maintenance: true},
+		{name: "plain fault", fault: true},
+		{name: "plain maintenance fault", maintenance: true, fault: true},
+		{name: "authenticated", auth: true},
+		{name: "authenticated maintenance", auth: true, maintenance: true},
+		{name: "authenticated fault", auth: true, fault: true},
+		{name: "authenticated maintenance fault", auth: true, maintenance: true, fault: true},
+		{name: "encrypted", auth: true, encrypt: true},
+		{name: "encrypted maintenance", auth: true, encrypt: true, maintenance: true},
+		{name: "encrypted fault", auth: true, encrypt: true, fault: true},
+		{name: "encrypted maintenance fault", auth: true, encrypt: true, maintenance: true, fault: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var tx, rx *authenticator
+			if c.auth {
+				tx, rx = testAuthenticator(t), testAuthenticator(t)
+			}
+			p := testPacket(tx)
+			p.maintenance, p.fault = c.maintenance, c.fault
+			b, err := encodePacket(p, tx, c.encrypt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodePacket(b, rx, "10.77.0.2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != p {
+				t.Errorf("decoded %+v, want %+v", got, p)
+			}
+			if c.auth {
+				if _, err := decodePacket(b, rx, "10.77.0.2"); !isPacketError(err, "replay") {
+					t.Errorf("replayed heartbeat: got %v, want a replay error", err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodePacketErrors(t *testing.T) {
+	tx, rx := testAuthenticator(t), testAuthenticator(t)
+	plain, err := encodePacket(testPacket(nil), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := encodePacket(testPacket(tx), tx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, signed...)
+	tampered[len(tampered)/2] ^= 1
+	version := append([]byte{}, plain...)
+	version[len(wireMagic)] = wireVersion + 1
+	role := append([]byte{}, plain...)
+	// the role follows the instance, node id, sequence and time
+	role[len(wireMagic)+3+4+1+len("node-a")+8+8] = byte(stateFault + 1)
+
+	for _, c := range []struct {
+		name   string
+		b      []byte
+		a      *authenticator
+		reason string
+	}{
+		{name: "empty", b: nil, reason: "format"},
+		{name: "json", b: []byte(`{"priority":100}`), reason: "format"},
+		{name: "version", b: version, reason: "format"},
+		{name: "truncated", b: plain[:len(plain)-1], reason: "format"},
+		{name: "trailing bytes", b: append(append([]byte{}, plain...), 0), reason: "format"},
+		{name: "unknown role", b: role, reason: "format"},
+		{name: "not authenticated", b: plain, a: rx, reason: "auth"},
+		{name: "no key configured", b: signed, reason: "auth"},
+		{name: "tampered", b: tampered, a: rx, reason: "checksum"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := decodePacket(c.b, c.a, "10.77.0.2"); !isPacketError(err, c.reason) {
+				t.Errorf("got %v, want a %s error", err, c.reason)
+			}
+		})
+	}
+}
+
+func isPacketError(err error, reason string) bool {
+	var pe *packetError
+	return errors.As(err, &pe) && pe.reason == reason
+}
+
+// FuzzDecodePacket makes sure that no input makes decodePacket panic and that every error is a *packetError
+func FuzzDecodePacket(f *testing.F) {
+	tx := testAuthenticator(f)
+	for _, a := range []*authenticator{nil, tx} {
+		for _, encrypt := range []bool{false, true} {
+			p := testPacket(a)
+			p.maintenance, p.fault = encrypt, !encrypt
+			b, err := encodePacket(p, a, encrypt)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(b)
+		}
+	}
+	f.Add([]byte(wireMagic))
+	f.Add([]byte{})
+	rx := testAuthenticator(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, a := range []*authenticator{nil, rx} {
+			p, err := decodePacket(b, a, "10.77.0.2")
+			if err != nil {
+				var pe *packetError
+				if !errors.As(err, &pe) {
+					t.Fatalf("error %v is a %T, not a *packetError", err, err)
+				}
+				continue
+			}
+			if p.role < stateInit || p.role > stateFault {
+				t.Fatalf("decoded the unknown role %d", p.role)
+			}
+		}
+	})
+}
@@ -0,0 +1,113 @@
+// Witness used as a tie-breaker when some peers can't be heard from, which may as well be a network partition.
+// A node only becomes (or stays) master without all of its peers when the witness votes for it.
+// The witness is either an arbiter (systemd_HA_arbiter.go) that leases its vote to a single node per instance,
+// or a list of addresses (e.g. the gateway) of which more than half must answer a ping.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+type witness interface {
+	// vote is asked for on every round, renew is the time until the next round
+	vote(renew time.Duration) bool
+}
+
+// newWitness returns nil when no witness is configured
+func newWitness(arbiter string, reach []string, instance int) (witness, error) {
+	if arbiter != "" {
+		addr, err := net.ResolveUDPAddr("udp", arbiter)
+		if err != nil {
+			return nil, err
+		}
+		return &arbiterWitness{addr: addr, instance: instance}, nil
+	}
+	if len(reach) > 0 {
+		return &reachWitness{targets: reach}, nil
+	}
+	return nil, nil
+}
+
+type arbiterRequest struct {
+	Instance int `json:"instance"`
+	// RenewMs is the time until the next request in milliseconds, the arbiter leases its vote for at least twice as long
+	RenewMs int64 `json:"renew_ms,omitempty"`
+}
+
+type arbiterResponse struct {
+	Instance int    `json:"instance"`
+	Granted  bool   `json:"granted"`
+	Holder   string `json:"holder"`
+}
+
+type arbiterWitness struct {
+	addr     *net.UDPAddr
+	instance int
+}
+
+// vote asks the arbiter for the lease of the instance. The lease is renewed on every call.
+func (w *arbiterWitness) vote(renew time.Duration) bool {
+	l, err := net.DialUDP("udp", nil, w.addr)
+	if err != nil {
+		log.Println("arbiter:", err)
+		return false
+	}
+	defer l.Close()
+	b, _ := json.Marshal(arbiterRequest{Instance: w.instance, RenewMs: renew.Milliseconds()})
+	if _, err := l.Write(b); err != nil {
+		log.Println("arbiter:", err)
+		return false
+	}
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 1500)
+	for {
+		n, err := l.Read(buffer)
+		if err != nil {
+			log.Println("arbiter:", err)
+			return false
+		}
+		var r arbiterResponse
+		if err := json.Unmarshal(buffer[:n], &r); err != nil || r.Instance != w.instance {
+			continue
+		}
+		if !r.Granted {
+			log.Println("arbiter gave its vote to", r.Holder)
+		}
+		return r.Granted
+	}
+}
+
+type reachWitness struct {
+	targets []string
+}
+
+// vote is granted when more than half of the targets answer a ping
+func (w *reachWitness) vote(renew time.Duration) bool {
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	reachable := 0
+	for _, t := range w.targets {
+		wg.Add(1)
+		go func(t string) {
+			defer wg.Done()
+			if err := exec.Command("ping", "-c", "1", "-W", "1", t).Run(); err != nil {
+				return
+			}
+			m.Lock()
+			reachable++
+			m.Unlock()
+		}(t)
+	}
+	wg.Wait()
+	if reachable*2 <= len(w.targets) {
+		log.Printf("only %d of %d witness addresses are reachable", reachable, len(w.targets))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,295 @@
+// hactl is the command line client of the control socket of systemd_HA.go and systemd_HA_v2.go
+// Usage: compile it and put it into /usr/bin, it has to run on the same machine as the daemon
+// go build -o hactl hactl.go
+// e.g. hactl status                        <-- state, priorities and services of this node
+// e.g. hactl instances                     <-- state of every instance of a daemon running several, -i 20 picks one for the other commands
+// e.g. hactl peers                         <-- peers of this node and when they were last heard from
+// e.g. hactl switchover --to 10.77.0.3     <-- hand the services over to a peer and wait until it is master, this node stays demoted and the peer promoted until hactl auto on each
+// e.g. hactl maintenance on                <-- keep heartbeating but never start or stop anything, until hactl maintenance off even across restarts
+// e.g. hactl freeze on                     <-- keep the current master in place
+// e.g. hactl demote / promote / auto       <-- hand the services over, take them over, follow the election again
+// e.g. hactl reset                         <-- end the hold of a node that changed its role too often and forget its failed probes
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type peerStatus struct {
+	Address       string     `json:"address"`
+	Node          string     `json:"node"`
+	State         string     `json:"state"`
+	Priority      int        `json:"priority"`
+	Handover      string     `json:"handover"`
+	LastHeartbeat *time.Time `json:"last_heartbeat"`
+	Alive         bool       `json:"alive"`
+	Compatible    bool       `json:"compatible"`
+	Maintenance   bool       `json:"maintenance"`
+	Fault         bool       `json:"fault"`
+	Resigned      bool       `json:"resigned"`
+}
+
+type serviceStatus struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	Error  string `json:"error"`
+}
+
+type nodeStatus struct {
+	Instance          int             `json:"instance"`
+	State             string          `json:"state"`
+	Since             time.Time       `json:"since"`
+	Priority          int             `json:"priority"`
+	EffectivePriority int             `json:"effective_priority"`
+	Override          string          `json:"override"`
+	Maintenance       bool            `json:"maintenance"`
+	Frozen            bool            `json:"frozen"`
+	Handover          string          `json:"handover"`
+	HeldSince         *time.Time      `json:"held_since"`
+	Peers             []peerStatus    `json:"peers"`
+	Services          []serviceStatus `json:"services"`
+	Tracks            []trackStatus   `json:"tracks"`
+}
+
+type trackStatus struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	Weight int    `json:"weight"`
+	Failed bool   `json:"failed"`
+}
+
+type client struct {
+	http *http.Client
+	// instance is the instance the commands apply to, empty when the daemon runs a single one
+	instance string
+}
+
+func main() {
+	socket := flag.String("s", "/run/systemd-services-HA.sock", "Unix socket of the daemon")
+	instance := flag.String("i", "", "Instance id, needed when the daemon runs several instances")
+	flag.Usage = printHelp
+	flag.Parse()
+	if flag.NArg() == 0 {
+		printHelp()
+		os.Exit(1)
+	}
+	c := &client{http: &http.Client{
+		Timeout: time.Second * 10,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *socket)
+			},
+		},
+	}, instance: *instance}
+	args := flag.Args()[1:]
+	var s nodeStatus
+	var err error
+	switch flag.Arg(0) {
+	case "status":
+		s, err = c.do(http.MethodGet, "/status", nil)
+		if err == nil {
+			printStatus(s)
+		}
+	case "instances":
+		err = c.instances()
+	case "peers":
+		s, err = c.do(http.MethodGet, "/status", nil)
+		if err == nil {
+			printPeers(s)
+		}
+	case "switchover":
+		err = c.switchover(args)
+	case "maintenance", "freeze":
+		if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+			log.Fatalf("usage: hactl %s on|off", flag.Arg(0))
+		}
+		s, err = c.do(http.MethodPost, "/"+flag.Arg(0), url.Values{"on": {fmt.Sprint(args[0] == "on")}})
+		if err == nil {
+			printStatus(s)
+		}
+	case "demote", "promote", "auto", "reset":
+		s, err = c.do(http.MethodPost, "/"+flag.Arg(0), nil)
+		if err == nil {
+			printStatus(s)
+		}
+	case "help":
+		printHelp()
+	default:
+		log.Println("unknown command", flag.Arg(0))
+		printHelp()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c *client) do(method, path string, query url.Values) (nodeStatus, error) {
+	var s nodeStatus
+	err := c.request(method, path, query, &s)
+	return s, err
+}
+
+// request sends the request for the instance of the client and decodes the json reply into v
+func (c *client) request(method, path string, query url.Values, v interface{}) error {
+	if c.instance != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("instance", c.instance)
+	}
+	u := "http://localhost" + path
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s", bytes.TrimSpace(b))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// instances prints a line for every instance of the daemon
+func (c *client) instances() error {
+	var list []nodeStatus
+	if err := c.request(http.MethodGet, "/instances", nil, &list); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tSTATE\tSINCE\tPRIORITY\tSERVICES")
+	for _, s := range list {
+		var services []string
+		for _, service := range s.Services {
+			services = append(services, service.Name)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d (effective %d)\t%s\n", s.Instance, s.State, s.Since.Format(time.RFC3339), s.Priority, s.EffectivePriority, strings.Join(services, " "))
+	}
+	return w.Flush()
+}
+
+// switchover asks the master to hand its services over and waits until the target confirms it is master
+func (c *client) switchover(args []string) error {
+	fs := flag.NewFlagSet("switchover", flag.ExitOnError)
+	to := fs.String("to", "", "Ip address of the peer to hand the services over to")
+	timeout := fs.Duration("timeout", time.Minute, "How long to wait for the peer to become master")
+	fs.Parse(args)
+	if *to == "" {
+		return fmt.Errorf("usage: hactl switchover --to <ip> [--timeout 1m]")
+	}
+	if _, err := c.do(http.MethodPost, "/switchover", url.Values{"to": {*to}}); err != nil {
+		return err
+	}
+	fmt.Printf("waiting for %s to become master\n", *to)
+	deadline := time.Now().Add(*timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		s, err := c.do(http.MethodGet, "/status", nil)
+		if err != nil {
+			return err
+		}
+		for _, p := range s.Peers {
+			host, _, _ := net.SplitHostPort(p.Address)
+			if (host == *to || p.Address == *to) && p.Alive && p.State == "MASTER" && s.State != "MASTER" {
+				fmt.Printf("%s is master, this node is %s\n", p.Address, s.State)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s did not become master within %s", *to, *timeout)
+}
+
+func printStatus(s nodeStatus) {
+	fmt.Printf("Instance:    %d\n", s.Instance)
+	fmt.Printf("State:       %s since %s\n", s.State, s.Since.Format(time.RFC3339))
+	fmt.Printf("Priority:    %d (effective %d)\n", s.Priority, s.EffectivePriority)
+	if s.Override != "" {
+		fmt.Printf("Override:    %s\n", s.Override)
+	}
+	if s.Handover != "" {
+		fmt.Printf("Switchover:  to %s\n", s.Handover)
+	}
+	if s.HeldSince != nil {
+		fmt.Printf("Flap hold:   since %s, hactl reset to end it\n", s.HeldSince.Format(time.RFC3339))
+	}
+	fmt.Printf("Maintenance: %v\n", s.Maintenance)
+	fmt.Printf("Frozen:      %v\n", s.Frozen)
+	fmt.Println("Services:")
+	for _, service := range s.Services {
+		state := "inactive"
+		if service.Active {
+			state = "active"
+		}
+		if service.Error != "" {
+			state = service.Error
+		}
+		fmt.Printf("  %s: %s\n", service.Name, state)
+	}
+	if len(s.Tracks) > 0 {
+		fmt.Println("Tracked:")
+	}
+	for _, t := range s.Tracks {
+		state := "ok"
+		if t.Failed {
+			state = "failed"
+		}
+		weight := "gives up the services"
+		if t.Weight > 0 {
+			weight = fmt.Sprintf("weight %d", t.Weight)
+		}
+		fmt.Printf("  %s %s: %s (%s)\n", t.Type, t.Target, state, weight)
+	}
+	printPeers(s)
+}
+
+func printPeers(s nodeStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tNODE\tSTATE\tPRIORITY\tALIVE\tLAST HEARTBEAT")
+	for _, p := range s.Peers {
+		last := "never"
+		if p.LastHeartbeat != nil {
+			last = time.Since(*p.LastHeartbeat).Round(time.Millisecond).String() + " ago"
+		}
+		state := p.State
+		if !p.Compatible && p.LastHeartbeat != nil {
+			state += " (incompatible)"
+		}
+		if p.Maintenance {
+			state += " (maintenance)"
+		}
+		if p.Fault {
+			state += " (fault)"
+		}
+		if p.Resigned {
+			state += " (shut down)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%v\t%s\n", p.Address, p.Node, state, p.Priority, p.Alive, last)
+	}
+	w.Flush()
+}
+
+func printHelp() {
+	fmt.Println("hactl [-s socket] [-i instance] command\n\n status, state, priorities and services of this node\n\n instances, state, priority and services of every instance of the daemon\n\n peers, peers of this node and when they were last heard from\n\n switchover --to <ip> [--timeout 1m], hand the services over to a peer and wait until it is master. This node stays demoted and the peer promoted until hactl auto is run on each\n\n maintenance on|off, keep heartbeating but never start or stop anything, kept across restarts of the daemon\n\n freeze on|off, keep the current master in place\n\n demote, promote, auto, hand the services over, take them over or follow the election again\n\n reset, end the hold of a node that changed its role too often and forget the failed probes and units kept since it gave the services up\n\n -s, unix socket of the daemon, default /run/systemd-services-HA.sock\n\n -i, instance id, needed when the daemon runs several instances")
+}
@@ -1,6 +1,16 @@
-// Purpose of this script is to synchronize systemd service between 2 linux instances so that if the target systemd service fail on the master linux instance, the slave would take over just like in other HA protocol like vrrp but this is for systemd service only.
+// Purpose of this script is to synchronize systemd service between 2 or more linux instances so that if the target systemd service fail on the master linux instance, the slave would take over just like in other HA protocol like vrrp but this is for systemd service only.
+// Every instance sends heartbeats to all of its peers (-D can be repeated) and the highest priority live instance runs the services.
 
 // In order to acheive this purpose, you need to create a seperate systemd service using the binary compiled from this script to work.
+// go build -o systemd-services-HA systemd_HA.go ha_*.go
+// The flags can be replaced by a configuration file with -CONFIG /etc/systemd-services-HA.yaml, systemctl reload then applies the changes that are safe to apply live.
+// A running instance can be checked and controlled with hactl (hactl.go) over the -CONTROL socket.
+// Several instances, each with its own peers, priority, services and virtual ip addresses, can share one daemon, see instances in ha_config.go.
+
+// Heartbeats use the packet format described in ha_wire.go, -LEGACY sends the json heartbeats of older versions while upgrading.
+// Maintenance mode is kept across restarts and turned on and off with hactl maintenance on|off or kill -USR1 / -USR2, see ha_maintenance.go.
+// On systemctl stop the master stops the services and resigns so that a backup takes over at once, -SHUTDOWN keep leaves them running, see ha_shutdown.go.
+// With Type=notify systemd waits until the heartbeats are received and the role is decided, see ha_sdnotify.go.
 
 // Sample Systemd service
 
@@ -8,10 +18,12 @@
 // Description=systemd service Availability checking tool.
 
 // [Service]
-// Type=simple
+// Type=notify
+// WatchdogSec=30s
 // Restart=on-failure
 // RestartSec=3
-// ExecStart=/etc/scripts/systemd-services-HA -D 10.77.0.2:9000 -L 0.0.0.0:8000 -P 100 -SERVICE [Whatever systemd service to target for] -I eth0
+// ExecStart=/etc/scripts/systemd-services-HA -D 10.77.0.2:9000 -D 10.77.0.3:9000 -L 0.0.0.0:8000 -P 100 -SERVICE [Whatever systemd service to target for] -I eth0 -VIP 10.77.0.10/24 -PROBE service=[service],type=systemctl
+// #ExecReload=kill -HUP $MAINPID
 // #ExecStop=pkill -f systemd-services-HA
 // [Install]
 // WantedBy=multi-user.target
@@ -21,11 +33,9 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"fmt"
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"time"
 )
 
@@ -33,11 +43,19 @@ type sendMessage struct {
 	Priority int      `json:"priority"`
 	Instance int      `json:"instance"`
 	Services []string `json:"services"`
+	State    string   `json:"state,omitempty"`
+	Handover string   `json:"handover,omitempty"`
+	Seq      uint64   `json:"seq,omitempty"`
+	Time     int64    `json:"time,omitempty"`
+	KeyID    string   `json:"key_id,omitempty"`
+	MAC      []byte   `json:"mac,omitempty"`
 }
 
+// recieveMessage is a heartbeat received from ipAddr, either a decoded packet (see ha_wire.go) or an older json heartbeat in Body
 type recieveMessage struct {
 	ipAddr *net.UDPAddr
 	Body   sendMessage
+	packet *packet
 }
 
 type serviceArray []string
@@ -53,105 +71,183 @@ func (i *serviceArray) Set(value string) error {
 func main() {
 
 	var services serviceArray
-	sendIPAddr := flag.String("D", "", "Destination Ip addrss and port number")
+	var sendIPAddrs peerArray
+	var vips vipArray
+	var probes probeArray
+	var tracks trackArray
+	var reach peerArray
+	var fences fenceArray
+	var hooks notifyArray
+	flag.Var(&sendIPAddrs, "D", "Destination Ip addrss and port number of a peer (could be multiple)")
 	listenIPAddr := flag.String("L", "", "Listen Ip address and port numeber")
-	priority := flag.Int("P", 100, "Priority of this server")
+	priority := flag.Int("P", 100, "Priority of this server, 1 to 254")
 	instance := flag.Int("ID", 10, "Instance ID of this connection")
-	netInterface := flag.String("I", "", "Network Interface to listen for udp traffic")
-	flag.Var(&services, "SERVICE", "Systemctl service to toggle")
+	netInterface := flag.String("I", "", "Network Interface to listen for udp traffic and to hold the virtual ip addresses")
+	flag.Var(&vips, "VIP", "Virtual ip address in CIDR notation that follows the master (could be multiple)")
+	flag.Var(&services, "SERVICE", "Systemctl service to toggle, started in the given order and stopped in reverse order. Units started together are joined with + and a start timeout can follow a / e.g. postgresql/5m or app+worker (could be multiple)")
+	flag.Var(&probes, "PROBE", "Health probe of a service e.g. service=nginx,type=http,target=http://127.0.0.1/,status=200,weight=50 (could be multiple)")
+	flag.Var(&tracks, "TRACK", "Interface or script tracked on every server, its weight is subtracted from the priority while it fails e.g. type=interface,target=eth1,weight=50 or type=script,target=/etc/scripts/check-gw.sh,weight=20. Without weight the server gives up the services (could be multiple)")
+	arbiter := flag.String("ARBITER", "", "Ip address and port number of the arbiter that breaks ties when peers are missing")
+	flag.Var(&reach, "REACH", "Ip address that must be reachable to run the services when peers are missing, more than half of them must answer (could be multiple)")
+	flag.Var(&fences, "FENCE", "Fencing action run against silent peers before taking over e.g. type=ssh,user=root or type=exec,target=/etc/scripts/fence.sh (could be multiple)")
+	control := flag.String("CONTROL", "/run/systemd-services-HA.sock", "Unix socket of the status and control api, empty to disable")
+	key := flag.String("KEY", "", "Shared passphrase to authenticate the heartbeats, must be the same on all peers")
+	keyFile := flag.String("KEYFILE", "", "File with the keys to authenticate the heartbeats, one 'id passphrase [not-after]' per line, the first one is used to send and can't expire (overrides -KEY)")
+	legacy := flag.Bool("LEGACY", false, "Send the heartbeats as json like older versions do, to upgrade the peers one at a time. Both formats are always accepted")
+	metrics := flag.String("METRICS", "", "Ip address and port to serve prometheus metrics on /metrics e.g. 127.0.0.1:9310")
+	advert := flag.Duration("ADVERT", time.Second*2, "Time between two heartbeats")
+	dead := flag.Int("DEAD", 5, "Number of missed heartbeats after which a peer is dead")
+	failback := flag.Duration("FAILBACK", 0, "How long this server waits before taking the services over from a live master, e.g. after it recovered (preempt delay)")
+	nopreempt := flag.Bool("NOPREEMPT", false, "Leave the services on a live master even when this server has a higher priority, should be set on all peers")
+	flapThreshold := flag.Int("FLAPS", 0, "Number of role changes within -FLAPWINDOW after which this server holds its role, it still takes the services over from a dead master and gives them up when it fails. 0 to disable")
+	flapWindow := flag.Duration("FLAPWINDOW", time.Minute*10, "Sliding window of the flap damping")
+	flapCooldown := flag.Duration("FLAPCOOLDOWN", time.Minute*30, "How long a flapping server holds its role, 0 to wait for hactl reset")
+	flag.Var(&hooks, "NOTIFY", "Notification of the transitions and of lost or regained peers e.g. type=exec,target=/etc/scripts/notify.sh or type=http,target=https://hooks.example.com/ha or type=syslog (could be multiple)")
+	maintenanceFile := flag.String("MAINTENANCEFILE", defaultMaintenanceFile, "Maintenance mode is on while this file exists, it is created and removed by hactl maintenance on|off, SIGUSR1 and SIGUSR2. Empty to not keep maintenance across restarts")
+	stateFile := flag.String("STATEFILE", defaultStateFile, "File the role, peers and sequence numbers are saved to, a master whose services still run keeps its role when the daemon restarts. Empty to start over on every restart")
+	shutdown := flag.String("SHUTDOWN", "stop", "What the master does with the services on SIGTERM: stop them in reverse order and hand them over at once, or keep them running for a restart of the daemon")
+	configFile := flag.String("CONFIG", "", "Configuration file used instead of the other flags, reloaded on SIGHUP, see ha_config.go")
 	flag.Parse()
-	s := make(chan recieveMessage, 1)
-	if len(services) == 0 || *sendIPAddr == "" || *listenIPAddr == "" {
-		log.Println("services,listening address and destination address must not be empty")
+	var cfg *config
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadConfig(*configFile); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		if len(services) == 0 || len(sendIPAddrs) == 0 || *listenIPAddr == "" {
+			log.Println("services,listening address and destination address must not be empty")
+			os.Exit(1)
+		}
+		cfg = &config{Listen: *listenIPAddr, Interface: *netInterface, Key: *key, KeyFile: *keyFile, Control: *control, Metrics: *metrics, StateFile: *stateFile,
+			Instances: []instanceConfig{{
+				Instance: *instance, Priority: *priority, Peers: sendIPAddrs, Services: services, VIPs: vips, Probes: probes, Track: tracks,
+				Arbiter: *arbiter, Reach: reach, Fences: fences, Notify: hooks,
+				AdvertInterval: *advert, DeadAdverts: *dead, FailbackDelay: *failback, NoPreempt: *nopreempt,
+				FlapThreshold: *flapThreshold, FlapWindow: *flapWindow, FlapCooldown: *flapCooldown,
+				MaintenanceFile: *maintenanceFile, Shutdown: *shutdown,
+			}}}
+	}
+	resolvedListenAddr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		log.Println(err)
 		os.Exit(1)
 	}
-	previousStatus := false
-	messageToSend := sendMessage{Priority: *priority, Instance: *instance, Services: services}
-	timeOutCounter := 0
-	//    stausCounter:=0
-	resolvedSendAddr, err := net.ResolveUDPAddr("udp", *sendIPAddr)
-	resolvedListenAddr, err := net.ResolveUDPAddr("udp", *listenIPAddr)
-	ief, err := net.InterfaceByName(*netInterface)
+	ief, err := net.InterfaceByName(cfg.Interface)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
-	log.Println("sending to", resolvedSendAddr)
-	go receiveMsg(s, resolvedListenAddr, ief)
-	logAlready := false
-	firstRun := true
-	for {
-		sendMsg(resolvedSendAddr, messageToSend)
-
-		select {
-		case data := <-s: // msg recieved
-
-			status, shutdown := checkStatus(messageToSend, data)
-			if !logAlready {
-				logAlready = true
-				if timeOutCounter%5 == 0 {
-					logAlready = false
-				}
-			}
-			if shutdown == true {
-				toggleService(messageToSend, false)
-			} else {
-				if status != previousStatus && status == true { //switch from inactive to active
-					log.Println("switch from inactive to active")
-					toggleService(messageToSend, true)
-
-					previousStatus = status
-				} else if status != previousStatus && status == false { //switch from active to inactive
-					//stop service
-					fmt.Println("switch from active to inactive")
-					toggleService(messageToSend, false)
-
-					previousStatus = status
-				}
-			}
-			if firstRun && !status {
-				toggleService(messageToSend, false)
-				firstRun = false
-			}
+	d, err := newDaemon(cfg, ief)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if d.auth == nil {
+		log.Println("no key given, heartbeats are not authenticated")
+	}
+	d.start()
+	go d.watchMaintenance()
+	go d.watchShutdown(func(n *node, p packet) {
+		// older versions would take priority 0 for a misconfigured peer, they only notice the silence
+		if *legacy {
+			return
+		}
+		data, err := encodePacket(p, n.auth, false)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, addr := range n.members.addrs() {
+			sendMsg(addr, data)
+		}
+	})
+	if *configFile != "" {
+		go d.watchConfig(*configFile, cfg)
+	}
+	if cfg.Control != "" {
+		if err := d.serveControl(cfg.Control); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+	if cfg.Metrics != "" {
+		d.serveMetrics(cfg.Metrics)
+	}
+	for _, n := range d.list() {
+		log.Println("instance", n.instance, "sending to", n.members.addrs())
+		go sendHeartbeats(n, *legacy)
+		go runInstance(n)
+	}
+	receiveMsg(resolvedListenAddr, d)
 
-			timeOutCounter = 0
+}
 
-		case <-time.After(time.Millisecond * 500): // wait for peer timeout
-			status := true
-			timeOutCounter++
-			if status != previousStatus && timeOutCounter >= 5 { //Timeout. switch from inactive to active
-				//start service
-				fmt.Println("Wait for peer Timeout. Switch from inactive to active")
-				toggleService(messageToSend, true)
-				previousStatus = status
-			}
-			if timeOutCounter >= 1000000 {
-				timeOutCounter = 6
+// sendHeartbeats sends the heartbeats of the node every advert interval, also while its election starts or stops the services
+func sendHeartbeats(n *node, legacy bool) {
+	messageToSend := sendMessage{Priority: n.priority, Instance: n.instance, Services: n.services}
+	for {
+		var data []byte
+		var err error
+		if legacy {
+			data, err = legacyMessage(&messageToSend, n)
+		} else {
+			data, err = encodePacket(n.nextPacket(), n.auth, false)
+		}
+		if err != nil {
+			log.Println("unable to send a heartbeat:", err)
+		} else {
+			for _, addr := range n.members.addrs() {
+				sendMsg(addr, data)
 			}
 		}
-		time.Sleep(time.Second * 2)
+		time.Sleep(n.interval())
 	}
+}
 
+// runInstance runs a round of the election of the node every advert interval, the heartbeats are recorded by receiveMsg meanwhile
+func runInstance(n *node) {
+	for {
+		time.Sleep(n.interval())
+		n.step(time.Now())
+	}
 }
 
-func sendMsg(sendAddr *net.UDPAddr, msg sendMessage) {
+// legacyMessage returns the heartbeat in the json format of older versions
+func legacyMessage(m *sendMessage, n *node) ([]byte, error) {
+	// older versions don't know about faults, a node in fault advertises the lowest priority instead
+	priority, fault := n.effective()
+	if fault {
+		priority = 1
+	}
+	m.Priority = priority
+	m.State = n.fsm.current().String()
+	m.Handover = n.handoverTarget()
+	if n.auth != nil {
+		k := n.auth.signingKey()
+		m.Seq, m.Time = n.auth.next()
+		m.KeyID = k.id
+		m.MAC = n.auth.sign(k, canonical(m.Instance, m.Priority, m.Services, m.State, m.Handover, m.Seq, m.Time))
+	}
+	return json.Marshal(m)
+}
+
+func sendMsg(sendAddr *net.UDPAddr, data []byte) {
 
 	l, err := net.DialUDP("udp", nil, sendAddr)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
-	var jsonData []byte
-	jsonData, err = json.Marshal(msg)
-	if err != nil {
-		log.Println(err)
-		os.Exit(1)
-	}
-	l.Write(jsonData)
+	defer l.Close()
+	l.Write(data)
 
 }
 
-func receiveMsg(c1 chan recieveMessage, addr *net.UDPAddr, ief *net.Interface) {
+// receiveMsg records every heartbeat in the instance it belongs to, heartbeats of other instances are ignored.
+// It never waits for an election, so an instance busy starting its services doesn't hold up the heartbeats of the others.
+func receiveMsg(addr *net.UDPAddr, d *daemon) {
 	l, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		log.Println(err)
@@ -159,6 +255,7 @@ func receiveMsg(c1 chan recieveMessage, addr *net.UDPAddr, ief *net.Interface) {
 	} else {
 		log.Println("listening at", addr)
 	}
+	go d.notifySystemd()
 	l.SetReadBuffer(1500)
 	b := make([]byte, 1500)
 	for {
@@ -167,50 +264,71 @@ func receiveMsg(c1 chan recieveMessage, addr *net.UDPAddr, ief *net.Interface) {
 			log.Fatal(err)
 			os.Exit(1)
 		}
-		jsonMessage := &recieveMessage{ipAddr: src}
-		json.Unmarshal(b[:n], &jsonMessage.Body)
-		c1 <- *jsonMessage
-		time.Sleep(time.Millisecond * 500)
+		jsonMessage := recieveMessage{ipAddr: src}
+		var instance int
+		if n > 0 && b[0] == '{' {
+			json.Unmarshal(b[:n], &jsonMessage.Body)
+			if d.auth != nil {
+				m := jsonMessage.Body
+				if err := d.auth.verify(src.IP.String(), m.Instance, m.KeyID, m.Seq, m.Time, canonical(m.Instance, m.Priority, m.Services, m.State, m.Handover, m.Seq, m.Time), m.MAC); err != nil {
+					log.Println("message recieved from peer addr", *src, "dropped:", err)
+					d.stats.heartbeatError("auth")
+					continue
+				}
+			}
+			instance = jsonMessage.Body.Instance
+			// older versions may leave the instance out, checkLegacyStatus tells the peer is incompatible
+			if instance == 0 && len(d.ids) == 1 {
+				instance = d.ids[0]
+			}
+		} else {
+			p, err := decodePacket(b[:n], d.auth, src.IP.String())
+			if err != nil {
+				log.Println("message recieved from peer addr", *src, "dropped:", err)
+				d.stats.heartbeatError(err.(*packetError).reason)
+				continue
+			}
+			jsonMessage.packet = &p
+			instance = p.instance
+		}
+		if self, ok := d.nodes[instance]; ok {
+			checkStatus(sendMessage{Instance: self.instance, Services: self.services}, jsonMessage, self)
+		}
 	}
 
 }
 
-func checkStatus(self sendMessage, peer recieveMessage) (bool, bool) {
-	//check whether received message is valid
-	if peer.Body.Instance == 0 || peer.Body.Priority == 0 || peer.Body.Services == nil {
-		log.Println("message recieved from peer addr", *peer.ipAddr, "but neccesary parameters are missing")
-		return false, true
+// checkStatus records the heartbeat of a peer sharing the same instance id
+func checkStatus(self sendMessage, peer recieveMessage, n *node) {
+	if peer.packet == nil {
+		checkLegacyStatus(self, peer, n)
+		return
 	}
-	if peer.Body.Instance == self.Instance {
-		if peer.Body.Priority < self.Priority {
-			if len(peer.Body.Services) == len(self.Services) {
-				return true, false
-			}
-		} else if peer.Body.Priority == self.Priority {
-			return false, true
-		}
+	p := peer.packet
+	hb := heartbeat{priority: p.priority, node: p.node, state: p.role.String(), handover: p.handover, maintenance: p.maintenance, fault: p.fault}
+	if p.services != serviceSetHash(self.Services) {
+		log.Println("peer addr", *peer.ipAddr, "has different services to monitor for")
+		n.members.observe(peer.ipAddr.IP, hb)
+		return
 	}
-	return false, false
+	hb.compatible = true
+	n.members.observe(peer.ipAddr.IP, hb)
 }
 
-func toggleService(self sendMessage, toggle bool) {
-	if toggle == false { //stop services
-		for i := 0; i < len(self.Services); i++ {
-			cmd := exec.Command("systemctl", "stop", self.Services[i])
-			_, err := cmd.CombinedOutput()
-			if err != nil {
-				log.Println(err)
-			}
-		}
-	} else {
-		for i := 0; i < len(self.Services); i++ {
-			cmd := exec.Command("systemctl", "start", self.Services[i])
-			out, err := cmd.CombinedOutput()
-			if err != nil {
-				log.Fatal(err)
-			}
-			log.Println(out)
-		}
+// checkLegacyStatus records a json heartbeat of an older peer, its mac has already been verified
+func checkLegacyStatus(self sendMessage, peer recieveMessage, n *node) {
+	hb := heartbeat{priority: peer.Body.Priority, state: peer.Body.State, handover: peer.Body.Handover}
+	//check whether received message is valid
+	if peer.Body.Instance == 0 || peer.Body.Priority == 0 || peer.Body.Services == nil {
+		log.Println("message recieved from peer addr", *peer.ipAddr, "but neccesary parameters are missing")
+		n.members.observe(peer.ipAddr.IP, hb)
+		return
 	}
-
+	if len(peer.Body.Services) != len(self.Services) {
+		log.Println("peer addr", *peer.ipAddr, "has different services to monitor for")
+		n.members.observe(peer.ipAddr.IP, hb)
+		return
+	}
+	hb.compatible = true
+	n.members.observe(peer.ipAddr.IP, hb)
 }
@@ -0,0 +1,96 @@
+// Arbiter for systemd_HA.go and systemd_HA_v2.go.
+// Run it on a third machine. When a node can't hear from all of its peers it asks the arbiter for a vote before it runs the services.
+// The vote of an instance is leased to a single node at a time so that two sides of a network partition can't both become master.
+// The master renews its lease on every round, a lease that isn't renewed expires after -lease, or twice the time between two rounds
+// of the master when that is longer, e.g. with a long advert interval.
+
+// Sample Systemd service
+
+// [Unit]
+// Description=systemd service Availability arbiter.
+
+// [Service]
+// Type=simple
+// Restart=on-failure
+// RestartSec=3
+// ExecStart=/etc/scripts/systemd-services-HA-arbiter -L 0.0.0.0:9100 -lease 15s
+// [Install]
+// WantedBy=multi-user.target
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+type request struct {
+	Instance int `json:"instance"`
+	// RenewMs is the time until the next request, older nodes don't send it
+	RenewMs int64 `json:"renew_ms"`
+}
+
+type response struct {
+	Instance int    `json:"instance"`
+	Granted  bool   `json:"granted"`
+	Holder   string `json:"holder"`
+}
+
+type lease struct {
+	holder  string
+	expires time.Time
+}
+
+func main() {
+	listenIPAddr := flag.String("L", "", "Listen Ip address and port number")
+	leaseTime := flag.Duration("lease", time.Second*15, "How long a vote is held without renewal, at least twice the advert interval of the node")
+	flag.Parse()
+	if *listenIPAddr == "" {
+		log.Println("listening address must not be empty")
+		os.Exit(1)
+	}
+	addr, err := net.ResolveUDPAddr("udp", *listenIPAddr)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	l, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	log.Println("listening at", addr)
+	leases := make(map[int]*lease)
+	b := make([]byte, 1500)
+	for {
+		n, src, err := l.ReadFromUDP(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var req request
+		if err := json.Unmarshal(b[:n], &req); err != nil {
+			log.Println("invalid request from", src)
+			continue
+		}
+		now := time.Now()
+		holder := src.IP.String()
+		current, ok := leases[req.Instance]
+		if !ok || now.After(current.expires) || current.holder == holder {
+			if !ok || current.holder != holder {
+				log.Printf("instance %d: vote given to %s", req.Instance, holder)
+			}
+			d := *leaseTime
+			if renew := 2 * time.Duration(req.RenewMs) * time.Millisecond; renew > d {
+				d = renew
+			}
+			current = &lease{holder: holder, expires: now.Add(d)}
+			leases[req.Instance] = current
+		}
+		resp, _ := json.Marshal(response{Instance: req.Instance, Granted: current.holder == holder, Holder: current.holder})
+		l.WriteToUDP(resp, src)
+	}
+}
@@ -1,35 +1,25 @@
+// High availability between systemd services on 2 or more linux servers, see --help.
+// Heartbeats use the packet format described in ha_wire.go.
+// go build -o systemd-services-HA systemd_HA_v2.go ha_*.go
+// It can run in a unit with Type=notify and WatchdogSec=, see ha_sdnotify.go.
+
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"time"
 )
 
 type input struct {
-	message              message
-	neighborIP, listenIP *net.IPAddr
-	password             string
-}
-
-type message struct {
-	priority int          `json:"priority"`
-	instance int          `json:"instance"`
-	services serviceArray `json:"services"`
-}
-type finalMessage struct {
-	checksum string `json:"checksum"`
-	message  []byte `json:"message"`
+	listenIP *net.UDPAddr
+	daemon   *daemon
+	// config holds the flags when no configuration file is given
+	config     *config
+	configFile string
 }
 
 type serviceArray []string
@@ -46,239 +36,190 @@ func main() {
 	input, err := parseInput()
 	if err != nil {
 		errorHandler(err)
+		os.Exit(1)
+	}
+	d := input.daemon
+	d.start()
+	go d.watchMaintenance()
+	go d.watchShutdown(advertise)
+	if input.configFile != "" {
+		go d.watchConfig(input.configFile, input.config)
+	}
+	if input.config.Control != "" {
+		if err := d.serveControl(input.config.Control); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if input.config.Metrics != "" {
+		d.serveMetrics(input.config.Metrics)
+	}
+	for _, n := range d.list() {
+		go sendMessage(n)
 	}
-	go sendMessage(input)
 	receiveMessage(input)
 
 }
 
+// receiveMessage hands every heartbeat to the instance it belongs to and runs the election of every instance
 func receiveMessage(i input) {
-	l, err := net.ListenIP("nil", i.listenIP)
+	l, err := net.ListenUDP("udp", i.listenIP)
 	if err != nil {
 		log.Fatal(err)
 	}
 	l.SetReadBuffer(1500)
 	buffer := make([]byte, 1500)
-	ch := make(chan bool, 2)
-	go func() {
-		for {
-			n, src, err := l.ReadFromIP(buffer)
-			if err != nil {
-				log.Fatal(err)
-			}
-			ch <- true
-			m := &finalMessage{}
-			json.Unmarshal(buffer[:n], &m)
-			if receivedMessage, ok := integrityCheck(m, i, src); ok {
-				preToggleServicesCheck(i.message, receivedMessage, false)
+	d := i.daemon
+	go d.notifySystemd()
+	for _, n := range d.list() {
+		go func(n *node) {
+			for {
+				n.step(time.Now())
+				time.Sleep(n.interval())
 			}
-			time.Sleep(time.Second * 5)
-		}
-	}()
+		}(n)
+	}
 	for {
-		select {
-		case <-ch:
-			//clear channel
-			for len(ch) > 0 {
-				<-ch
-			}
-
-		case <-time.After(time.Second * 10):
-			var dummyMessage message
-			preToggleServicesCheck(i.message, dummyMessage, true)
-
+		size, src, err := l.ReadFromUDP(buffer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p, err := decodePacket(buffer[:size], d.auth, src.IP.String())
+		if err != nil {
+			log.Printf("Message from %s dropped: %v", src.IP, err)
+			d.stats.heartbeatError(err.(*packetError).reason)
+			continue
 		}
-		time.Sleep(time.Second * 5)
+		n, ok := d.nodes[p.instance]
+		if !ok {
+			continue
+		}
+		n.members.observe(src.IP, heartbeat{
+			priority:    p.priority,
+			node:        p.node,
+			state:       p.role.String(),
+			handover:    p.handover,
+			maintenance: p.maintenance,
+			fault:       p.fault,
+			compatible:  preToggleServicesCheck(n, p),
+		})
 	}
 }
 
-func preToggleServicesCheck(self message, neighbor message, force bool) {
-	if force {
-		go toggleServices(self.services, true)
-		return
-	}
+// preToggleServicesCheck reports whether the neighbor runs a compatible configuration
+func preToggleServicesCheck(self *node, neighbor packet) bool {
 	if self.instance != neighbor.instance {
 		log.Println("Two servers have the different instance id. Stopping all services to prevent damages.")
-		go toggleServices(self.services, false)
-
-		return
+		return false
 	}
-	if !sameStringSlice(self.services, neighbor.services) {
+	if serviceSetHash(self.services) != neighbor.services {
 		log.Println("Two servers have different services to monitor for. Stopping all services to prevent damages")
-		go toggleServices(self.services, false)
-
-		return
-	}
-	if self.priority < neighbor.priority {
-		go toggleServices(self.services, false)
-
-		return
-	}
-	go toggleServices(self.services, true)
-}
-
-func toggleServices(s []string, on bool) {
-	var action string
-	if on {
-		action = "start"
-	} else {
-		action = "stop"
-	}
-	for i := 0; i < len(s); i++ {
-		cmd := exec.Command("systemctl", action, s[i])
-		if err := cmd.Run(); err != nil {
-			log.Println(err)
-		}
-	}
-}
-
-func sameStringSlice(x, y []string) bool {
-	if len(x) != len(y) {
 		return false
 	}
-	diff := make(map[string]int, len(x))
-	for _, _x := range x {
-		diff[_x]++
-	}
-	for _, _y := range y {
-		if _, ok := diff[_y]; !ok {
-			return false
-		}
-		diff[_y]--
-		if diff[_y] == 0 {
-			delete(diff, _y)
-		}
-	}
-	if len(diff) == 0 {
-		return true
-	}
-	return false
+	return true
 }
 
-func integrityCheck(m *finalMessage, i input, src *net.IPAddr) (message, bool) {
-	var decryptedMessage []byte
-	reconstructedMessage := &message{}
-	if len(i.password) > 0 {
-		decryptedMessage = decryption(i.password, m.message)
-	} else {
-		decryptedMessage = m.message
-	}
-	json.Unmarshal(decryptedMessage, &reconstructedMessage)
-	h := hash(*reconstructedMessage)
-	if h != m.checksum {
-		log.Printf("Checksum from %s doesn't match", src.IP)
-		return *reconstructedMessage, false
-	}
-	return *reconstructedMessage, true
-}
-func decryption(password string, message []byte) []byte {
-	c, err := aes.NewCipher([]byte(password))
-	if err != nil {
-		log.Fatal(err)
-	}
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	nonceSize := gcm.NonceSize()
-	if len(message) < nonceSize {
-		log.Fatal(err)
-	}
-	nonce, ciphertext := message[:nonceSize], message[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		fmt.Println(err)
+func sendMessage(n *node) {
+	for {
+		advertise(n, n.nextPacket())
+		time.Sleep(n.interval())
 	}
-	return plaintext
-
 }
 
-func sendMessage(i input) {
-	var f finalMessage
-	l, err := net.DialIP("udp", i.neighborIP, nil)
+// advertise sends the heartbeat p of the node to its neighbors
+func advertise(n *node, p packet) {
+	data, err := encodePacket(p, n.auth, true)
 	if err != nil {
 		log.Println(err)
+		return
 	}
-	f.checksum = hash(i.message)
-	if len(i.password) > 0 {
-		f.message, err = encryption(i.message, i.password)
+	for _, addr := range n.members.addrs() {
+		l, err := net.DialUDP("udp", nil, addr)
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
+			continue
 		}
-	} else {
-		f.message = []byte(fmt.Sprintf("%v", i.message))
+		l.Write(data)
+		l.Close()
 	}
-	for {
-		l.Write([]byte(fmt.Sprintf("%v", f)))
-		time.Sleep(time.Second * 5)
-	}
-}
-
-func hash(m message) string {
-	h := sha256.New()
-	h.Write([]byte(fmt.Sprintf("%v", m)))
-	return fmt.Sprintf("%x", h.Sum(nil))
-}
-
-func encryption(m message, p string) ([]byte, error) {
-	var encryptedData []byte
-	jsonData, err := json.Marshal(m)
-	if err != nil {
-		return encryptedData, err
-	}
-	c, err := aes.NewCipher([]byte(p))
-	if err != nil {
-		return encryptedData, err
-	}
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		return encryptedData, err
-	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return encryptedData, err
-	}
-	encryptedData = gcm.Seal(nonce, nonce, jsonData, nil)
-	return encryptedData, nil
 }
 
 func parseInput() (input, error) {
 	var i input
 	var services serviceArray
+	var neighbors peerArray
+	var probes probeArray
+	var tracks trackArray
+	var reach peerArray
+	var fences fenceArray
+	var hooks notifyArray
 	if len(os.Args) < 2 {
 		return i, fmt.Errorf("Missing arguments")
 	}
 	if os.Args[1] == "--help" || os.Args[1] == "help" || os.Args[1] == "-help" {
-		fmt.Printf("The purpose of the program is to provide high availability between systemd services on 2 linux servers\n\n -n, ip address and port of the neigbor e.g. 192.168.10.2:9000\n\n -l, ip address and port to listen on\n\n -p, priority of this machine\n\n -i, instance id. Note that the instance id must be the same between 2 servers\n\n -pass, password for encryption and authenication. Note that if the password is empty, no encryption would be done!\n\n -s, systemd services to toggle (could be multiple)\n")
+		fmt.Printf("The purpose of the program is to provide high availability between systemd services on 2 or more linux servers\n\n -n, ip address and port of a neigbor e.g. 192.168.10.2:9000 (could be multiple)\n\n -l, ip address and port to listen on\n\n -p, priority of this machine, 1 to 254\n\n -i, instance id. Note that the instance id must be the same on all servers\n\n -pass, password for encryption and authenication. The keys are derived from it with scrypt and HKDF. Heartbeats are signed with a HMAC, carry a sequence number and are dropped when replayed. Note that if the password is empty, no encryption nor authentication would be done!\n\n -keyfile, file with one key per line as 'id passphrase [not-after]' e.g. '2026-09 previous-passphrase 2026-11-01T00:00:00Z'. The first key encrypts the heartbeats and can't have a not-after time, every key that hasn't passed its not-after time is accepted so that keys can be rotated one node at a time. Overrides -pass\n\n -s, systemd services to toggle, started in the given order and stopped in reverse order. Units started together are joined with + and a start timeout can follow a / e.g. -s data.mount/30s -s postgresql/5m -s app+worker. If a service fails to start the ones already started are stopped and this machine goes to FAULT (could be multiple)\n\n -probe, health probe of a service e.g. service=nginx,type=tcp,target=127.0.0.1:80,weight=50. A probe without weight makes this machine give up mastership when it fails (could be multiple)\n\n -track, interface or script tracked whether this machine runs the services or not e.g. type=interface,target=eth1,weight=50 (link followed over netlink) or type=script,target=/etc/scripts/check-gw.sh,weight=20 (must exit with 0). The weight is subtracted from the priority while it fails so that the master hands the services over, without weight this machine gives up mastership (could be multiple)\n\n -arbiter, ip address and port of the arbiter that breaks ties when neighbors are missing\n\n -reach, ip address that must be reachable to run the services when neighbors are missing, more than half of them must answer (could be multiple)\n\n -fence, fencing action run against silent neighbors before taking over e.g. type=ssh,user=root or type=http,target=http://pdu/off?host={peer}. If fencing fails the services are not started (could be multiple)\n\n -control, unix socket of the status and control api, default /run/systemd-services-HA.sock. Empty to disable\n\n -metrics, ip address and port to serve prometheus metrics on /metrics e.g. 127.0.0.1:9310\n\n -advert, time between two heartbeats, default 5s\n\n -dead, number of missed heartbeats after which a neighbor is dead, default 2\n\n -failback, how long this machine waits before taking the services over from a live master e.g. after it recovered. The delay starts over while this machine is unhealthy, default 0s\n\n -nopreempt, leave the services on a live master even when this machine has a higher priority, until the master fails or is demoted. Should be set on all servers\n\n -flaps, number of role changes within -flapwindow after which this machine holds its current role. A held machine still takes the services over from a dead master and gives them up when it fails, 0 to disable, default 0\n\n -flapwindow, sliding window of the flap damping, default 10m\n\n -flapcooldown, how long a flapping machine holds its role, 0 to wait for hactl reset, default 30m\n\n -notify, notification of the transitions and of lost or regained neighbors, run in the background e.g. type=exec,target=/etc/scripts/notify.sh (HA_EVENT, HA_FROM, HA_TO, HA_REASON, HA_PEER and HA_INSTANCE in its environment) or type=http,target=https://hooks.example.com/ha (json POST) or type=syslog (could be multiple)\n\n -maintenancefile, maintenance mode is on while this file exists, this machine then keeps sending heartbeats but never starts or stops anything and its neighbors don't treat it as failed. The file is created and removed by hactl maintenance on|off, SIGUSR1 and SIGUSR2 and kept across restarts, {instance} is replaced with the instance id. Empty to not keep maintenance across restarts, default /var/lib/systemd-services-HA/maintenance-{instance}\n\n -statefile, file the role, neighbors and sequence numbers are saved to. When the daemon restarts, e.g. after a crash, a master whose services still run keeps its role without stopping them unless a neighbor took them over meanwhile. Empty to start over on every restart, default /var/lib/systemd-services-HA/state.json\n\n -shutdown, what the master does with its services on SIGTERM or SIGINT. stop stops them in reverse order and then sends heartbeats with priority 0 so that a neighbor takes them over at once, keep leaves them running without telling the neighbors, for a restart of the daemon. Nothing is stopped in maintenance mode, default stop\n\n -config, yaml configuration file used instead of the other flags, see ha_config.go. It can hold several instances, each with its own neighbors, priority and services, that share the listen address, the keys, the control socket and the metrics. On SIGHUP the priority, neighbors, probes, tracked items, arbiter, reach, fences, keys, timers, nopreempt, flap damping, notifications and shutdown are reloaded, other changes are rejected until a restart\n")
 		os.Exit(0)
 	}
-	neighborIP := flag.String("n", "", "")
+	flag.Var(&neighbors, "n", "")
 	listenIP := flag.String("l", "", "")
 	priority := flag.Int("p", -1, "")
 	instanceID := flag.Int("i", -1, "")
 	password := flag.String("pass", "", "")
+	keyFile := flag.String("keyfile", "", "")
 	flag.Var(&services, "s", "")
+	flag.Var(&probes, "probe", "")
+	flag.Var(&tracks, "track", "")
+	arbiter := flag.String("arbiter", "", "")
+	flag.Var(&reach, "reach", "")
+	flag.Var(&fences, "fence", "")
+	control := flag.String("control", "/run/systemd-services-HA.sock", "")
+	metrics := flag.String("metrics", "", "")
+	advert := flag.Duration("advert", time.Second*5, "")
+	dead := flag.Int("dead", 2, "")
+	failback := flag.Duration("failback", 0, "")
+	nopreempt := flag.Bool("nopreempt", false, "")
+	flapThreshold := flag.Int("flaps", 0, "")
+	flapWindow := flag.Duration("flapwindow", time.Minute*10, "")
+	flapCooldown := flag.Duration("flapcooldown", time.Minute*30, "")
+	flag.Var(&hooks, "notify", "")
+	maintenanceFile := flag.String("maintenancefile", defaultMaintenanceFile, "")
+	stateFile := flag.String("statefile", defaultStateFile, "")
+	shutdown := flag.String("shutdown", "stop", "")
+	configFile := flag.String("config", "", "")
 	flag.Parse()
-	if len(*neighborIP) == 0 || len(*listenIP) == 0 || *priority == -1 || *instanceID == -1 || len(services) == 0 {
-		return i, fmt.Errorf("Missing arguments")
-	}
-	if len(*password) == 0 {
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			return i, err
+		}
+		i.config = c
+		i.configFile = *configFile
+	} else {
+		if len(neighbors) == 0 || len(*listenIP) == 0 || *priority == -1 || *instanceID == -1 || len(services) == 0 {
+			return i, fmt.Errorf("Missing arguments")
+		}
+		i.config = &config{Listen: *listenIP, Key: *password, KeyFile: *keyFile, Control: *control, Metrics: *metrics, StateFile: *stateFile,
+			Instances: []instanceConfig{{
+				Instance: *instanceID, Priority: *priority, Peers: neighbors, Services: services, Probes: probes, Track: tracks,
+				Arbiter: *arbiter, Reach: reach, Fences: fences, Notify: hooks,
+				AdvertInterval: *advert, DeadAdverts: *dead, FailbackDelay: *failback, NoPreempt: *nopreempt,
+				FlapThreshold: *flapThreshold, FlapWindow: *flapWindow, FlapCooldown: *flapCooldown,
+				MaintenanceFile: *maintenanceFile, Shutdown: *shutdown,
+			}}}
+	}
+	if len(i.config.Key) == 0 && len(i.config.KeyFile) == 0 {
 		log.Println("Missing password. The communication would be in plain-text")
 	}
-	neightbor, err := net.ResolveIPAddr("udp", *neighborIP)
+	self, err := net.ResolveUDPAddr("udp", i.config.Listen)
 	if err != nil {
-		return i, fmt.Errorf("Incorrect neighbor IP address")
+		return i, fmt.Errorf("Incorrect self IP address")
 	}
-	self, err := net.ResolveIPAddr("udp", *listenIP)
+	// virtual ip addresses are only supported by systemd_HA.go
+	d, err := newDaemon(i.config, nil)
 	if err != nil {
-		return i, fmt.Errorf("Incorrect self IP address")
+		return i, err
 	}
-	m := message{priority: *priority, instance: *instanceID, services: services}
-	i.message = m
-	i.neighborIP = neightbor
 	i.listenIP = self
-	i.password = *password
+	i.daemon = d
 	return i, nil
 }
 